@@ -0,0 +1,548 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tailscale/hujson"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigFile = "config.json"
+
+const errConfigInvalid = Error("config is invalid")
+
+// configLogLevels mirrors the AppConfig logLevel values of the frontend.
+var configLogLevels = []string{"OFF", "ERROR", "WARN", "INFO", "DEBUG", "TRACE"}
+
+// configOption describes a single top-level key of the frontend config.json.
+// It is the single source of truth for validation and for generating example
+// configs, so new options only need to be added here.
+type configOption struct {
+	Key         string
+	Description string
+	Options     []string
+	// Default is the JSON encoded default value. Options without a static
+	// default (e.g. derived from the current page) leave this empty.
+	Default     string
+	DefaultNote string
+	Example     string
+	Validate    func(path string, raw json.RawMessage) []error
+}
+
+var configSchema = []configOption{
+	{
+		Key:         "logLevel",
+		Description: "Console log level. Useful for debugging.",
+		Options:     configLogLevels,
+		Default:     `"INFO"`,
+		Validate: func(path string, raw json.RawMessage) []error {
+			var level string
+			if err := json.Unmarshal(raw, &level); err != nil {
+				return []error{configErrorf(path, "must be a string")}
+			}
+			if !slices.Contains(configLogLevels, level) {
+				return []error{configErrorf(path, "invalid value %q, expected one of %s", level, strings.Join(configLogLevels, ", "))}
+			}
+			return nil
+		},
+	},
+	{
+		Key:         "controlUrl",
+		Description: "The control server url. E.g. https://headscale.example.com",
+		DefaultNote: "Current page",
+		Example:     `"https://headscale.example.com"`,
+		Validate: func(path string, raw json.RawMessage) []error {
+			var controlURL string
+			if err := json.Unmarshal(raw, &controlURL); err != nil {
+				return []error{configErrorf(path, "must be a string")}
+			}
+			if err := validateControlURL(controlURL); err != nil {
+				return []error{configErrorf(path, "%v", err)}
+			}
+			return nil
+		},
+	},
+	{
+		Key:         "tags",
+		Description: "Tags applied to clients (Usually only apply when using a authkey).",
+		Default:     `[]`,
+		Example:     `["tag:js"]`,
+		Validate: func(path string, raw json.RawMessage) []error {
+			var tags []json.RawMessage
+			if err := json.Unmarshal(raw, &tags); err != nil {
+				return []error{configErrorf(path, "must be an array of strings")}
+			}
+			var errs []error
+			for i, rawTag := range tags {
+				tagPath := fmt.Sprintf("%s[%d]", path, i)
+				var tag string
+				if err := json.Unmarshal(rawTag, &tag); err != nil {
+					errs = append(errs, configErrorf(tagPath, "must be a string"))
+					continue
+				}
+				if err := validateTag(tag); err != nil {
+					errs = append(errs, configErrorf(tagPath, "%v", err))
+				}
+			}
+			return errs
+		},
+	},
+	{
+		Key:         "preferredDERPRegion",
+		Description: "DERP region ID used as home region instead of the one with the lowest latency.",
+		DefaultNote: "Region with the lowest latency",
+		Example:     `900`,
+		Validate: func(path string, raw json.RawMessage) []error {
+			var regionID int
+			if err := json.Unmarshal(raw, &regionID); err != nil {
+				return []error{configErrorf(path, "must be an integer")}
+			}
+			if regionID < 1 {
+				return []error{configErrorf(path, "must be a positive region ID")}
+			}
+			return nil
+		},
+	},
+	{
+		Key:         "defaults",
+		Description: "User settings defaults. Keys match the settings page, values are strings or null.",
+		Default:     `{}`,
+		Validate: func(path string, raw json.RawMessage) []error {
+			var defaults map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &defaults); err != nil || defaults == nil {
+				return []error{configErrorf(path, "must be an object")}
+			}
+			var errs []error
+			for _, key := range sortedKeys(defaults) {
+				var value *string
+				if err := json.Unmarshal(defaults[key], &value); err != nil {
+					errs = append(errs, configErrorf(path+"."+key, "must be a string or null"))
+				}
+			}
+			return errs
+		},
+	},
+}
+
+// configError points at the offending key of a config file.
+type configError struct {
+	Path string
+	Msg  string
+	// Unknown is set for keys missing from configSchema. serve only warns
+	// about them, so a config keeps loading across versions.
+	Unknown bool
+}
+
+func (e configError) Error() string { return e.Path + ": " + e.Msg }
+
+func configErrorf(path, format string, args ...any) error {
+	return configError{Path: path, Msg: fmt.Sprintf(format, args...)}
+}
+
+func validateControlURL(controlURL string) error {
+	u, err := url.Parse(controlURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url %q, scheme must be http or https", controlURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid url %q, host is missing", controlURL)
+	}
+	return nil
+}
+
+func validateTag(tag string) error {
+	if !strings.HasPrefix(tag, "tag:") || len(tag) == len("tag:") {
+		return fmt.Errorf("invalid tag %q, expected format tag:<name>", tag)
+	}
+	return nil
+}
+
+// parseConfig validates a config file and returns it as standard JSON with
+// comments and trailing commas removed. All problems are reported at once.
+func parseConfig(data []byte) ([]byte, []error) {
+	standardized, err := hujson.Standardize(data)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(standardized, &fields); err != nil || fields == nil {
+		return nil, []error{Error("config must be a JSON object")}
+	}
+
+	var errs []error
+	for _, key := range sortedKeys(fields) {
+		idx := slices.IndexFunc(configSchema, func(o configOption) bool { return o.Key == key })
+		if idx < 0 {
+			errs = append(errs, configError{Path: key, Msg: "unknown option", Unknown: true})
+			continue
+		}
+		errs = append(errs, configSchema[idx].Validate(key, fields[key])...)
+	}
+
+	return standardized, errs
+}
+
+// splitUnknownOptions separates the errors about unknown keys from the others.
+func splitUnknownOptions(errs []error) (unknown, other []error) {
+	for _, err := range errs {
+		if ce, ok := err.(configError); ok && ce.Unknown {
+			unknown = append(unknown, err)
+		} else {
+			other = append(other, err)
+		}
+	}
+	return unknown, other
+}
+
+// loadConfigFile reads and validates the config at path. If optional is set, a
+// missing file is not an error and nil is returned.
+func loadConfigFile(path string, optional bool) ([]byte, []error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && optional {
+			return nil, nil
+		}
+		return nil, []error{err}
+	}
+	return parseConfig(data)
+}
+
+// decodeConfigFile strictly decodes the YAML (.yaml, .yml) or JSON file at
+// path into v. Unknown keys are rejected.
+func decodeConfigFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		return dec.Decode(v)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(v)
+	}
+}
+
+type configValues struct {
+	LogLevel            string
+	ControlURL          string
+	Tags                []string
+	PreferredDERPRegion int
+	Defaults            map[string]string
+}
+
+// renderExampleConfig writes a commented config containing every option of
+// configSchema. Values provided in v override the defaults, options without a
+// value or default are emitted commented out.
+func renderExampleConfig(w io.Writer, v configValues) error {
+	values := map[string]string{}
+	if v.LogLevel != "" {
+		values["logLevel"] = jsonString(v.LogLevel)
+	}
+	if v.ControlURL != "" {
+		values["controlUrl"] = jsonString(v.ControlURL)
+	}
+	if len(v.Tags) > 0 {
+		tags, err := json.Marshal(v.Tags)
+		if err != nil {
+			return err
+		}
+		values["tags"] = string(tags)
+	}
+	if v.PreferredDERPRegion != 0 {
+		values["preferredDERPRegion"] = strconv.Itoa(v.PreferredDERPRegion)
+	}
+	if len(v.Defaults) > 0 {
+		defaults, err := json.Marshal(v.Defaults)
+		if err != nil {
+			return err
+		}
+		values["defaults"] = string(defaults)
+	}
+
+	var b strings.Builder
+	b.WriteString("// headscale-console config\n")
+	b.WriteString("// Comments and trailing commas are stripped by `headscale-console serve`.\n")
+	b.WriteString("{\n")
+	for i, opt := range configSchema {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "  // %s\n", opt.Description)
+		if len(opt.Options) > 0 {
+			fmt.Fprintf(&b, "  // Options: %s\n", strings.Join(opt.Options, ", "))
+		}
+		if opt.Default != "" {
+			fmt.Fprintf(&b, "  // Default: %s\n", opt.Default)
+		} else if opt.DefaultNote != "" {
+			fmt.Fprintf(&b, "  // Default: %s\n", opt.DefaultNote)
+		}
+
+		if value, ok := values[opt.Key]; ok {
+			fmt.Fprintf(&b, "  %q: %s,\n", opt.Key, value)
+		} else if opt.Default != "" {
+			fmt.Fprintf(&b, "  %q: %s,\n", opt.Key, opt.Default)
+		} else {
+			fmt.Fprintf(&b, "  // %q: %s,\n", opt.Key, opt.Example)
+		}
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func init() {
+	configInitCmd.Flags().StringP("output", "o", defaultConfigFile, "Path to write the config to, - for stdout")
+	configInitCmd.Flags().Bool("force", false, "Overwrite an existing config file")
+	configInitCmd.Flags().BoolP("interactive", "i", false, "Prompt for every option")
+	configInitCmd.Flags().String("app-log-level", "", "Value for logLevel")
+	configInitCmd.Flags().String("control-url", "", "Value for controlUrl")
+	configInitCmd.Flags().StringSlice("tags", nil, "Values for tags")
+	configInitCmd.Flags().Int("preferred-derp-region", 0, "Value for preferredDERPRegion")
+	configInitCmd.Flags().StringToString("defaults", nil, "Values for defaults, e.g. open-connect-new-tab=true")
+
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configInitCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Validate or create the frontend config.json",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Validate a config file the same way serve does",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile := viper.GetString("serve.configfile")
+		if len(args) == 1 {
+			configfile = args[0]
+		}
+		if configfile == "" {
+			configfile = defaultConfigFile
+		}
+
+		_, errs := loadConfigFile(configfile, false)
+		for _, err := range errs {
+			log.Error().Str("configfile", configfile).Msg(err.Error())
+		}
+		if len(errs) > 0 {
+			log.Fatal().
+				Str("configfile", configfile).
+				Int("problems", len(errs)).
+				Err(errConfigInvalid).
+				Msg("Validation failed")
+		}
+
+		log.Info().Str("configfile", configfile).Msg("Config is valid")
+	},
+}
+
+var configInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Write a commented example config with every supported option",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		force, _ := cmd.Flags().GetBool("force")
+		interactive, _ := cmd.Flags().GetBool("interactive")
+
+		var values configValues
+		values.LogLevel, _ = cmd.Flags().GetString("app-log-level")
+		values.ControlURL, _ = cmd.Flags().GetString("control-url")
+		values.Tags, _ = cmd.Flags().GetStringSlice("tags")
+		values.PreferredDERPRegion, _ = cmd.Flags().GetInt("preferred-derp-region")
+		values.Defaults, _ = cmd.Flags().GetStringToString("defaults")
+
+		if interactive {
+			if err := promptConfigValues(cmd.InOrStdin(), cmd.ErrOrStderr(), &values); err != nil {
+				log.Fatal().Err(err).Msg("Failed to read input")
+			}
+		}
+
+		var b strings.Builder
+		if err := renderExampleConfig(&b, values); err != nil {
+			log.Fatal().Err(err).Msg("Failed to render config")
+		}
+
+		// Never write something serve would refuse to load.
+		if _, errs := parseConfig([]byte(b.String())); len(errs) > 0 {
+			for _, err := range errs {
+				log.Error().Msg(err.Error())
+			}
+			log.Fatal().Err(errConfigInvalid).Msg("Refusing to write config")
+		}
+
+		if output == "-" {
+			fmt.Fprint(cmd.OutOrStdout(), b.String())
+			return
+		}
+
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if force {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(output, flags, 0o644)
+		if err != nil {
+			log.Fatal().Err(err).Str("configfile", output).Msg("Failed to create configfile")
+		}
+		defer f.Close()
+
+		if _, err := f.WriteString(b.String()); err != nil {
+			log.Fatal().Err(err).Str("configfile", output).Msg("Failed to write configfile")
+		}
+
+		log.Info().Str("configfile", output).Msg("Config written")
+	},
+}
+
+func promptConfigValues(in io.Reader, out io.Writer, v *configValues) error {
+	scanner := bufio.NewScanner(in)
+	prompt := func(label, current string, validate func(string) error) (string, error) {
+		for {
+			fmt.Fprintf(out, "%s [%s]: ", label, current)
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return "", err
+				}
+				return current, nil
+			}
+			answer := strings.TrimSpace(scanner.Text())
+			if answer == "" {
+				return current, nil
+			}
+			if err := validate(answer); err != nil {
+				fmt.Fprintln(out, err)
+				continue
+			}
+			return answer, nil
+		}
+	}
+
+	var err error
+	if v.LogLevel == "" {
+		v.LogLevel = "INFO"
+	}
+	v.LogLevel, err = prompt("logLevel ("+strings.Join(configLogLevels, ", ")+")", v.LogLevel, func(s string) error {
+		if !slices.Contains(configLogLevels, s) {
+			return fmt.Errorf("expected one of %s", strings.Join(configLogLevels, ", "))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	v.ControlURL, err = prompt("controlUrl (empty for current page)", v.ControlURL, validateControlURL)
+	if err != nil {
+		return err
+	}
+
+	tags, err := prompt("tags (comma separated)", strings.Join(v.Tags, ","), func(s string) error {
+		for _, tag := range strings.Split(s, ",") {
+			if err := validateTag(strings.TrimSpace(tag)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	v.Tags = nil
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			v.Tags = append(v.Tags, tag)
+		}
+	}
+
+	region := ""
+	if v.PreferredDERPRegion != 0 {
+		region = strconv.Itoa(v.PreferredDERPRegion)
+	}
+	region, err = prompt("preferredDERPRegion (empty for lowest latency)", region, func(s string) error {
+		if id, err := strconv.Atoi(s); err != nil || id < 1 {
+			return errors.New("expected a positive region ID")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	v.PreferredDERPRegion, _ = strconv.Atoi(region)
+
+	defaults, err := prompt("defaults (comma separated key=value)", formatConfigDefaults(v.Defaults), func(s string) error {
+		_, err := parseConfigDefaults(s)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	v.Defaults, _ = parseConfigDefaults(defaults)
+
+	return nil
+}
+
+// parseConfigDefaults parses the comma separated key=value pairs of the
+// defaults prompt.
+func parseConfigDefaults(s string) (map[string]string, error) {
+	defaults := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if key = strings.TrimSpace(key); !ok || key == "" {
+			return nil, fmt.Errorf("invalid default %q, expected key=value", pair)
+		}
+		defaults[key] = strings.TrimSpace(value)
+	}
+	return defaults, nil
+}
+
+func formatConfigDefaults(defaults map[string]string) string {
+	pairs := make([]string, 0, len(defaults))
+	for _, key := range sortedKeys(defaults) {
+		pairs = append(pairs, key+"="+defaults[key])
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderExampleConfigParses(t *testing.T) {
+	tests := []struct {
+		name   string
+		values configValues
+		want   map[string]any
+	}{
+		{
+			name:   "defaults",
+			values: configValues{},
+			want: map[string]any{
+				"logLevel": "INFO",
+				"tags":     []any{},
+				"defaults": map[string]any{},
+			},
+		},
+		{
+			name: "every option",
+			values: configValues{
+				LogLevel:            "DEBUG",
+				ControlURL:          "https://headscale.example.com",
+				Tags:                []string{"tag:js"},
+				PreferredDERPRegion: 900,
+				Defaults:            map[string]string{"open-connect-new-tab": "true"},
+			},
+			want: map[string]any{
+				"logLevel":            "DEBUG",
+				"controlUrl":          "https://headscale.example.com",
+				"tags":                []any{"tag:js"},
+				"preferredDERPRegion": float64(900),
+				"defaults":            map[string]any{"open-connect-new-tab": "true"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := renderExampleConfig(&b, tt.values); err != nil {
+				t.Fatal(err)
+			}
+			parsed, errs := parseConfig([]byte(b.String()))
+			if len(errs) > 0 {
+				t.Fatalf("parseConfig: %v\n%s", errs, b.String())
+			}
+			var got map[string]any
+			if err := json.Unmarshal(parsed, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("config = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptConfigValues(t *testing.T) {
+	// Invalid answers are asked again, empty ones keep the current value.
+	in := strings.Join([]string{
+		"VERBOSE", "DEBUG",
+		"",
+		"js, tag:js", "tag:js, tag:web",
+		"-1", "900",
+		"open-connect-new-tab", "open-connect-new-tab=true, open-connect-popup = false",
+	}, "\n")
+	v := configValues{ControlURL: "https://headscale.example.com"}
+	if err := promptConfigValues(strings.NewReader(in), &strings.Builder{}, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	want := configValues{
+		LogLevel:            "DEBUG",
+		ControlURL:          "https://headscale.example.com",
+		Tags:                []string{"tag:js", "tag:web"},
+		PreferredDERPRegion: 900,
+		Defaults:            map[string]string{"open-connect-new-tab": "true", "open-connect-popup": "false"},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("values = %+v, want %+v", v, want)
+	}
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Connection protocols supported by the frontend and their default ports.
+var connectionProtocolPorts = map[string]int{
+	"ssh":  22,
+	"vnc":  5900,
+	"rdp":  3389,
+	"http": 80,
+}
+
+// connectionsFile is the admin managed list of connection presets served at
+// /connections.json.
+type connectionsFile struct {
+	Connections []connectionPreset `json:"connections" yaml:"connections"`
+}
+
+// connectionPreset targets peers either by name or by tag. The WASM module
+// resolves it against the current netmap.
+type connectionPreset struct {
+	Name     string `json:"name" yaml:"name"`
+	Protocol string `json:"protocol" yaml:"protocol"`
+	Peer     string `json:"peer,omitempty" yaml:"peer"`
+	Tag      string `json:"tag,omitempty" yaml:"tag"`
+	Port     int    `json:"port,omitempty" yaml:"port"`
+	// Username is used by ssh and rdp.
+	Username string `json:"username,omitempty" yaml:"username"`
+	// Scheme and Path are used by http.
+	Scheme string `json:"scheme,omitempty" yaml:"scheme"`
+	Path   string `json:"path,omitempty" yaml:"path"`
+	// Groups restricts the preset to users in one of the groups. Presets
+	// without groups are visible to everybody.
+	Groups []string `json:"groups,omitempty" yaml:"groups"`
+}
+
+// loadConnectionsFile reads and validates a connections file. YAML is used for
+// .yaml and .yml files, JSON otherwise.
+func loadConnectionsFile(path string) (*connectionsFile, []error) {
+	var file connectionsFile
+	if err := decodeConfigFile(path, &file); err != nil {
+		return nil, []error{err}
+	}
+
+	if errs := file.validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	return &file, nil
+}
+
+func (f *connectionsFile) validate() []error {
+	var errs []error
+	names := map[string]bool{}
+	for i, c := range f.Connections {
+		path := fmt.Sprintf("connections[%d]", i)
+		if c.Name == "" {
+			errs = append(errs, configErrorf(path+".name", "is required"))
+		} else if names[c.Name] {
+			errs = append(errs, configErrorf(path+".name", "duplicate name %q", c.Name))
+		}
+		names[c.Name] = true
+
+		if _, ok := connectionProtocolPorts[c.Protocol]; !ok {
+			errs = append(errs, configErrorf(path+".protocol", "invalid value %q, expected one of ssh, vnc, rdp, http", c.Protocol))
+		}
+
+		switch {
+		case c.Peer == "" && c.Tag == "":
+			errs = append(errs, configErrorf(path, "either peer or tag is required"))
+		case c.Peer != "" && c.Tag != "":
+			errs = append(errs, configErrorf(path, "peer and tag are mutually exclusive"))
+		case c.Tag != "":
+			if err := validateTag(c.Tag); err != nil {
+				errs = append(errs, configErrorf(path+".tag", "%v", err))
+			}
+		}
+
+		if c.Port < 0 || c.Port > 65535 {
+			errs = append(errs, configErrorf(path+".port", "must be between 1 and 65535"))
+		}
+		if c.Username != "" && c.Protocol != "ssh" && c.Protocol != "rdp" {
+			errs = append(errs, configErrorf(path+".username", "only supported by ssh and rdp"))
+		}
+		if c.Protocol != "http" && (c.Scheme != "" || c.Path != "") {
+			errs = append(errs, configErrorf(path, "scheme and path are only supported by http"))
+		}
+		if c.Scheme != "" && c.Scheme != "http" && c.Scheme != "https" {
+			errs = append(errs, configErrorf(path+".scheme", "invalid value %q, expected http or https", c.Scheme))
+		}
+		if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+			errs = append(errs, configErrorf(path+".path", "must start with /"))
+		}
+		for j, group := range c.Groups {
+			if strings.TrimSpace(group) == "" {
+				errs = append(errs, configErrorf(fmt.Sprintf("%s.groups[%d]", path, j), "must not be empty"))
+			}
+		}
+	}
+	return errs
+}
+
+// forGroups returns the presets visible to a user in the given groups.
+func (f *connectionsFile) forGroups(groups []string) connectionsFile {
+	visible := connectionsFile{Connections: []connectionPreset{}}
+	for _, c := range f.Connections {
+		if len(c.Groups) == 0 || slices.ContainsFunc(c.Groups, func(g string) bool { return slices.Contains(groups, g) }) {
+			c.Groups = nil
+			visible.Connections = append(visible.Connections, c)
+		}
+	}
+	return visible
+}
+
+// requestGroups reads the groups of the authenticated user from a header set
+// by an authenticating reverse proxy (e.g. X-Forwarded-Groups).
+func requestGroups(r *http.Request, header string) []string {
+	if header == "" {
+		return nil
+	}
+	var groups []string
+	for _, value := range r.Header.Values(header) {
+		for _, group := range strings.Split(value, ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// handler serves the presets visible to the user, whose groups are read from
+// groupsHeader.
+func (f *connectionsFile) handler(groupsHeader string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// Filtered per user, must not be shared between users.
+		w.Header().Set("Cache-Control", "private, no-store")
+		err := json.NewEncoder(w).Encode(f.forGroups(requestGroups(r, groupsHeader)))
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("requestId", r.Context().Value("requestId").(string)).
+				Msg("Failed to send response")
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+	}
+}
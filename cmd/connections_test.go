@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestConnectionsValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection connectionPreset
+		wantErrs   int
+	}{
+		{"valid peer", connectionPreset{Name: "db", Protocol: "ssh", Peer: "db1", Username: "root"}, 0},
+		{"valid tag", connectionPreset{Name: "web", Protocol: "http", Tag: "tag:web", Scheme: "https", Path: "/admin"}, 0},
+		{"missing name", connectionPreset{Protocol: "ssh", Peer: "db1"}, 1},
+		{"invalid protocol", connectionPreset{Name: "db", Protocol: "telnet", Peer: "db1"}, 1},
+		{"no target", connectionPreset{Name: "db", Protocol: "ssh"}, 1},
+		{"peer and tag", connectionPreset{Name: "db", Protocol: "ssh", Peer: "db1", Tag: "tag:db"}, 1},
+		{"invalid tag", connectionPreset{Name: "db", Protocol: "ssh", Tag: "db"}, 1},
+		{"port out of range", connectionPreset{Name: "db", Protocol: "ssh", Peer: "db1", Port: 70000}, 1},
+		{"username for vnc", connectionPreset{Name: "db", Protocol: "vnc", Peer: "db1", Username: "root"}, 1},
+		{"path for ssh", connectionPreset{Name: "db", Protocol: "ssh", Peer: "db1", Path: "/"}, 1},
+		{"invalid scheme", connectionPreset{Name: "web", Protocol: "http", Peer: "web1", Scheme: "ftp"}, 1},
+		{"relative path", connectionPreset{Name: "web", Protocol: "http", Peer: "web1", Path: "admin"}, 1},
+		{"empty group", connectionPreset{Name: "db", Protocol: "ssh", Peer: "db1", Groups: []string{"ops", " "}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := connectionsFile{Connections: []connectionPreset{tt.connection}}
+			if errs := file.validate(); len(errs) != tt.wantErrs {
+				t.Errorf("got %d errors, want %d: %v", len(errs), tt.wantErrs, errs)
+			}
+		})
+	}
+
+	t.Run("duplicate name", func(t *testing.T) {
+		c := connectionPreset{Name: "db", Protocol: "ssh", Peer: "db1"}
+		file := connectionsFile{Connections: []connectionPreset{c, c}}
+		if errs := file.validate(); len(errs) != 1 {
+			t.Errorf("got %d errors, want 1: %v", len(errs), errs)
+		}
+	})
+}
+
+func testConnectionsFile() *connectionsFile {
+	return &connectionsFile{Connections: []connectionPreset{
+		{Name: "public", Protocol: "http", Tag: "tag:web"},
+		{Name: "ops", Protocol: "ssh", Tag: "tag:prod", Groups: []string{"ops"}},
+		{Name: "dba", Protocol: "ssh", Peer: "db1", Groups: []string{"dba", "ops"}},
+	}}
+}
+
+func presetNames(f connectionsFile) []string {
+	names := []string{}
+	for _, c := range f.Connections {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func TestConnectionsForGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups []string
+		want   []string
+	}{
+		{"no groups", nil, []string{"public"}},
+		{"one group", []string{"dba"}, []string{"public", "dba"}},
+		{"several groups", []string{"dev", "ops"}, []string{"public", "ops", "dba"}},
+		{"unknown group", []string{"dev"}, []string{"public"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			visible := testConnectionsFile().forGroups(tt.groups)
+			if got := presetNames(visible); !slices.Equal(got, tt.want) {
+				t.Errorf("forGroups(%v) = %v, want %v", tt.groups, got, tt.want)
+			}
+			for _, c := range visible.Connections {
+				if c.Groups != nil {
+					t.Errorf("groups of %q are exposed: %v", c.Name, c.Groups)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestGroups(t *testing.T) {
+	const header = "X-Forwarded-Groups"
+	tests := []struct {
+		name   string
+		header string
+		values []string
+		want   []string
+	}{
+		{"no header configured", "", []string{"ops"}, nil},
+		{"header missing", header, nil, nil},
+		{"one group", header, []string{"ops"}, []string{"ops"}},
+		{"comma separated", header, []string{"ops, dba,"}, []string{"ops", "dba"}},
+		{"repeated header", header, []string{"ops", "dba"}, []string{"ops", "dba"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/connections.json", nil)
+			for _, v := range tt.values {
+				req.Header.Add(header, v)
+			}
+			if got := requestGroups(req, tt.header); !slices.Equal(got, tt.want) {
+				t.Errorf("requestGroups = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectionsHandler(t *testing.T) {
+	const header = "X-Forwarded-Groups"
+	tests := []struct {
+		name   string
+		groups []string
+		want   []string
+	}{
+		{"no header", nil, []string{"public"}},
+		{"one group", []string{"dba"}, []string{"public", "dba"}},
+		{"several groups", []string{"ops,dba"}, []string{"public", "ops", "dba"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newLoggingMiddleware(testConnectionsFile().handler(header))
+
+			req := httptest.NewRequest(http.MethodGet, "/connections.json", nil)
+			for _, g := range tt.groups {
+				req.Header.Add(header, g)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "private, no-store" {
+				t.Errorf("Cache-Control = %q, want private, no-store", got)
+			}
+			var file connectionsFile
+			if err := json.Unmarshal(rec.Body.Bytes(), &file); err != nil {
+				t.Fatal(err)
+			}
+			if got := presetNames(file); !slices.Equal(got, tt.want) {
+				t.Errorf("presets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,558 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+// Subprotocols the WASM client requests when upgrading to WebSocket. Mirrors
+// tailscale.com/control/controlhttp and tailscale.com/derp/derphttp.
+const (
+	controlWebsocketSubprotocol = "tailscale-control-protocol"
+	derpWebsocketSubprotocol    = "derp"
+)
+
+func init() {
+	doctorCmd.Flags().Int("timeout", 10, "Timeout per check in seconds")
+	viper.BindPFlag("doctor.timeout", doctorCmd.Flags().Lookup("timeout"))
+
+	doctorCmd.Flags().String("derp-map", "", "URL or path (JSON/YAML) of the DERP map headscale uses. Defaults to <controlUrl>/derpmap/default")
+	viper.BindPFlag("doctor.derp-map", doctorCmd.Flags().Lookup("derp-map"))
+
+	doctorCmd.Flags().StringP("output", "o", "text", "Output format (text, json)")
+	viper.BindPFlag("doctor.output", doctorCmd.Flags().Lookup("output"))
+
+	doctorCmd.Flags().Bool("insecure", false, "Skip TLS certificate verification")
+	viper.BindPFlag("doctor.insecure", doctorCmd.Flags().Lookup("insecure"))
+
+	doctorCmd.Flags().String("ca-file", "", "PEM encoded CA certificates used to verify the servers")
+	viper.BindPFlag("doctor.ca-file", doctorCmd.Flags().Lookup("ca-file"))
+
+	rootCmd.AddCommand(doctorCmd)
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor <console-url>",
+	Short: "Diagnose CORS, WebSocket and DERP problems of a deployment",
+	Long: `Diagnose a deployment the way the browser sees it.
+
+Fetches config.json from the console, checks the control server's /key
+endpoint, CORS responses for the console origin, the control WebSocket upgrade
+and whether every DERP region accepts WebSocket connections.`,
+	Example: "headscale-console doctor https://headscale.example.com/admin",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		output := viper.GetString("doctor.output")
+		if output != "text" && output != "json" {
+			log.Fatal().Str("output", output).Msg("Invalid output format")
+		}
+
+		client, err := newHTTPClient(
+			time.Duration(viper.GetInt("doctor.timeout"))*time.Second,
+			viper.GetBool("doctor.insecure"),
+			viper.GetString("doctor.ca-file"),
+		)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid TLS options")
+		}
+
+		d, err := newDoctor(client, args[0], viper.GetString("doctor.derp-map"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid console url")
+		}
+
+		report := d.run(cmd.Context())
+
+		if output == "json" {
+			if err := json.NewEncoder(cmd.OutOrStdout()).Encode(report); err != nil {
+				log.Fatal().Err(err).Msg("Failed to encode report")
+			}
+		} else {
+			report.print(cmd.OutOrStdout())
+		}
+
+		if !report.OK {
+			os.Exit(1)
+		}
+	},
+}
+
+type doctor struct {
+	client     *http.Client
+	consoleURL *url.URL
+	origin     string
+	derpMap    string
+}
+
+func newDoctor(client *http.Client, consoleURL, derpMap string) (*doctor, error) {
+	u, err := url.Parse(consoleURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q, expected http(s)://host/path", consoleURL)
+	}
+	return &doctor{
+		client:     client,
+		consoleURL: u,
+		origin:     urlOrigin(u),
+		derpMap:    derpMap,
+	}, nil
+}
+
+type doctorReport struct {
+	OK         bool          `json:"ok"`
+	ConsoleURL string        `json:"consoleUrl"`
+	ControlURL string        `json:"controlUrl,omitempty"`
+	Checks     []doctorCheck `json:"checks"`
+}
+
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+func (r *doctorReport) add(c doctorCheck) {
+	if c.Result == doctorFail {
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+func (r doctorReport) print(w io.Writer) {
+	fmt.Fprintf(w, "Console: %s\n", r.ConsoleURL)
+	if r.ControlURL != "" {
+		fmt.Fprintf(w, "Control: %s\n", r.ControlURL)
+	}
+	fmt.Fprintln(w)
+	for _, c := range r.Checks {
+		fmt.Fprintf(w, "[%s] %s", strings.ToUpper(c.Result), c.Name)
+		if c.Detail != "" {
+			fmt.Fprintf(w, ": %s", c.Detail)
+		}
+		fmt.Fprintln(w)
+		if c.Hint != "" {
+			fmt.Fprintf(w, "       hint: %s\n", c.Hint)
+		}
+	}
+	fmt.Fprintln(w)
+	if r.OK {
+		fmt.Fprintln(w, "No problems found")
+	} else {
+		fmt.Fprintln(w, "Problems found, see hints above")
+	}
+}
+
+func (d *doctor) run(ctx context.Context) doctorReport {
+	report := doctorReport{OK: true, ConsoleURL: d.consoleURL.String()}
+
+	controlURL, check := d.checkConfig(ctx)
+	report.add(check)
+	if controlURL == nil {
+		return report
+	}
+	report.ControlURL = controlURL.String()
+
+	report.add(d.checkControlKey(ctx, controlURL))
+	report.add(d.checkCORS(ctx, controlURL))
+	report.add(d.checkControlWebsocket(ctx, controlURL))
+
+	derpMap, check := d.loadDERPMap(ctx, controlURL)
+	report.add(check)
+	if derpMap != nil {
+		for _, c := range d.checkDERPRegions(ctx, derpMap) {
+			report.add(c)
+		}
+	}
+
+	return report
+}
+
+// checkConfig loads config.json the way the frontend does and returns the
+// control url the browser is going to use.
+func (d *doctor) checkConfig(ctx context.Context) (*url.URL, doctorCheck) {
+	check := doctorCheck{Name: "config.json"}
+	// The frontend falls back to the root of the current page.
+	controlURL := d.consoleURL.ResolveReference(&url.URL{Path: "/"})
+
+	uri := d.consoleURL.JoinPath("config.json")
+	resp, body, err := d.get(ctx, uri.String(), nil)
+	if err != nil {
+		check.Result = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "Make sure the console url is reachable from here, including the base path (e.g. /admin)"
+		return nil, check
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		check.Result = doctorPass
+		check.Detail = "not provided, using defaults"
+		return controlURL, check
+	case resp.StatusCode != http.StatusOK:
+		check.Result = doctorFail
+		check.Detail = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		check.Hint = "config.json is optional, but must either return 200 or 404"
+		return controlURL, check
+	}
+
+	// The frontend silently ignores the config otherwise.
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+		check.Result = doctorFail
+		check.Detail = fmt.Sprintf("served as %q, the frontend ignores it", contentType)
+		check.Hint = "Serve config.json with exactly 'Content-Type: application/json'"
+		return controlURL, check
+	}
+
+	config, errs := parseConfig(body)
+	unknown, errs := splitUnknownOptions(errs)
+	if len(errs) > 0 {
+		check.Result = doctorFail
+		check.Detail = errors.Join(errs...).Error()
+		check.Hint = "Run `headscale-console config validate` against the file"
+		return controlURL, check
+	}
+
+	var values struct {
+		ControlURL string `json:"controlUrl"`
+	}
+	if err := json.Unmarshal(config, &values); err == nil && values.ControlURL != "" {
+		if u, err := url.Parse(values.ControlURL); err == nil {
+			controlURL = u
+		}
+	}
+
+	if len(unknown) > 0 {
+		check.Result = doctorWarn
+		check.Detail = errors.Join(unknown...).Error()
+		check.Hint = "The frontend ignores unknown options, remove them or upgrade the console"
+		return controlURL, check
+	}
+
+	check.Result = doctorPass
+	check.Detail = "valid"
+	return controlURL, check
+}
+
+// checkControlKey fetches the control server's public noise key, the first
+// request the client makes.
+func (d *doctor) checkControlKey(ctx context.Context, controlURL *url.URL) doctorCheck {
+	check := doctorCheck{Name: "control /key"}
+
+	uri := controlURL.JoinPath("key")
+	uri.RawQuery = url.Values{"v": {strconv.Itoa(int(tailcfg.CurrentCapabilityVersion))}}.Encode()
+
+	resp, body, err := d.get(ctx, uri.String(), nil)
+	if err != nil {
+		check.Result = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "controlUrl must point at the server_url of headscale"
+		return check
+	}
+	if resp.StatusCode != http.StatusOK {
+		check.Result = doctorFail
+		check.Detail = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		check.Hint = "controlUrl must point at the server_url of headscale, check the reverse proxy routes /key to it"
+		return check
+	}
+
+	var keys tailcfg.OverTLSPublicKeyResponse
+	if err := json.Unmarshal(body, &keys); err != nil || keys.PublicKey.IsZero() {
+		check.Result = doctorFail
+		check.Detail = "response does not contain a control public key"
+		check.Hint = "controlUrl must point at the server_url of headscale, not at the console"
+		return check
+	}
+
+	check.Result = doctorPass
+	check.Detail = keys.PublicKey.ShortString()
+	return check
+}
+
+// checkCORS verifies the control server allows requests from the console
+// origin. Same origin deployments do not need any headers.
+func (d *doctor) checkCORS(ctx context.Context, controlURL *url.URL) doctorCheck {
+	check := doctorCheck{Name: "CORS"}
+
+	if urlOrigin(controlURL) == d.origin {
+		check.Result = doctorSkip
+		check.Detail = "console and control server share the same origin"
+		return check
+	}
+
+	hint := fmt.Sprintf("Configure the reverse proxy of headscale to answer with 'Access-Control-Allow-Origin: %s' and handle OPTIONS preflight requests", d.origin)
+	uri := controlURL.JoinPath("key")
+	uri.RawQuery = url.Values{"v": {strconv.Itoa(int(tailcfg.CurrentCapabilityVersion))}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, uri.String(), nil)
+	if err != nil {
+		check.Result = doctorFail
+		check.Detail = err.Error()
+		return check
+	}
+	req.Header.Set("Origin", d.origin)
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		check.Result = doctorFail
+		check.Detail = "preflight: " + err.Error()
+		check.Hint = hint
+		return check
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		check.Result = doctorFail
+		check.Detail = fmt.Sprintf("preflight returned status %d", resp.StatusCode)
+		check.Hint = hint
+		return check
+	}
+	if !corsAllows(resp.Header, d.origin) {
+		check.Result = doctorFail
+		check.Detail = fmt.Sprintf("preflight does not allow origin %s (Access-Control-Allow-Origin: %q)", d.origin, resp.Header.Get("Access-Control-Allow-Origin"))
+		check.Hint = hint
+		return check
+	}
+
+	resp, _, err = d.get(ctx, uri.String(), http.Header{"Origin": {d.origin}})
+	if err != nil {
+		check.Result = doctorFail
+		check.Detail = err.Error()
+		check.Hint = hint
+		return check
+	}
+	if !corsAllows(resp.Header, d.origin) {
+		check.Result = doctorFail
+		check.Detail = fmt.Sprintf("GET does not allow origin %s (Access-Control-Allow-Origin: %q)", d.origin, resp.Header.Get("Access-Control-Allow-Origin"))
+		check.Hint = hint
+		return check
+	}
+
+	check.Result = doctorPass
+	check.Detail = "origin " + d.origin + " allowed"
+	return check
+}
+
+// checkControlWebsocket upgrades to the noise endpoint like the WASM client.
+// Without a handshake headscale closes the connection right after the upgrade,
+// which is enough to know the reverse proxy passes WebSockets through.
+func (d *doctor) checkControlWebsocket(ctx context.Context, controlURL *url.URL) doctorCheck {
+	check := doctorCheck{Name: "control WebSocket"}
+
+	uri := controlURL.JoinPath("ts2021")
+	uri.Scheme = websocketScheme(uri.Scheme)
+
+	if err := d.dialWebsocket(ctx, uri.String(), controlWebsocketSubprotocol); err != nil {
+		check.Result = doctorFail
+		check.Detail = err.Error()
+		check.Hint = "The reverse proxy in front of headscale must forward the 'Upgrade' and 'Connection' headers on /ts2021"
+		return check
+	}
+
+	check.Result = doctorPass
+	check.Detail = "upgrade accepted"
+	return check
+}
+
+// loadDERPMap reads the DERP map from a file or url. Headscale does not expose
+// its DERP map without authentication, so it has to be provided unless the
+// control server serves /derpmap/default.
+func (d *doctor) loadDERPMap(ctx context.Context, controlURL *url.URL) (*tailcfg.DERPMap, doctorCheck) {
+	check := doctorCheck{Name: "DERP map"}
+	hint := "Pass --derp-map with the url or file configured in derp.urls / derp.paths of headscale"
+
+	source := d.derpMap
+	explicit := source != ""
+	if !explicit {
+		source = controlURL.JoinPath("derpmap", "default").String()
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if u, parseErr := url.Parse(source); parseErr == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		var resp *http.Response
+		resp, data, err = d.get(ctx, source, nil)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status %d from %s", resp.StatusCode, source)
+			if !explicit {
+				check.Result = doctorSkip
+				check.Detail = "control server does not serve a DERP map"
+				check.Hint = hint
+				return nil, check
+			}
+		}
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		check.Result = doctorFail
+		check.Detail = err.Error()
+		check.Hint = hint
+		return nil, check
+	}
+
+	derpMap := new(tailcfg.DERPMap)
+	switch filepath.Ext(source) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, derpMap)
+	default:
+		err = json.Unmarshal(data, derpMap)
+	}
+	if err != nil {
+		check.Result = doctorFail
+		check.Detail = "failed to parse: " + err.Error()
+		check.Hint = hint
+		return nil, check
+	}
+	if len(derpMap.Regions) == 0 {
+		check.Result = doctorFail
+		check.Detail = "no regions"
+		check.Hint = "Browsers can only reach peers through DERP, at least one region is required"
+		return nil, check
+	}
+
+	check.Result = doctorPass
+	check.Detail = fmt.Sprintf("%d regions from %s", len(derpMap.Regions), source)
+	return derpMap, check
+}
+
+// checkDERPRegions verifies every region has at least one node accepting a
+// WebSocket upgrade, the only transport available to browsers.
+func (d *doctor) checkDERPRegions(ctx context.Context, derpMap *tailcfg.DERPMap) []doctorCheck {
+	var checks []doctorCheck
+	for _, regionID := range derpMap.RegionIDs() {
+		region := derpMap.Regions[regionID]
+		check := doctorCheck{Name: fmt.Sprintf("DERP region %d (%s)", region.RegionID, region.RegionCode)}
+
+		var failures []string
+		var warnings []string
+		for _, node := range region.Nodes {
+			if node.STUNOnly {
+				continue
+			}
+			if node.DERPPort != 0 && node.DERPPort != 443 {
+				warnings = append(warnings, fmt.Sprintf("%s uses port %d which browsers ignore", node.Name, node.DERPPort))
+			}
+			if err := d.dialWebsocket(ctx, derpNodeURL(node), derpWebsocketSubprotocol); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", node.Name, err))
+				continue
+			}
+			check.Detail = "node " + node.Name + " accepts WebSockets"
+			break
+		}
+
+		switch {
+		case check.Detail == "":
+			check.Result = doctorFail
+			check.Detail = strings.Join(failures, "; ")
+			if check.Detail == "" {
+				check.Detail = "no DERP nodes"
+			}
+			check.Hint = "Browsers connect to DERP at wss://<hostname>/derp, make sure the DERP server (or its reverse proxy) accepts WebSocket upgrades on port 443"
+		case len(warnings) > 0:
+			check.Result = doctorWarn
+			check.Detail += "; " + strings.Join(warnings, "; ")
+			check.Hint = "Browsers always connect to DERP on port 443"
+		default:
+			check.Result = doctorPass
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+func (d *doctor) get(ctx context.Context, uri string, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+func (d *doctor) dialWebsocket(ctx context.Context, uri, subprotocol string) error {
+	conn, resp, err := websocket.Dial(ctx, uri, &websocket.DialOptions{
+		HTTPClient:   d.client,
+		HTTPHeader:   http.Header{"Origin": {d.origin}},
+		Subprotocols: []string{subprotocol},
+	})
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("upgrade rejected with status %d", resp.StatusCode)
+		}
+		return err
+	}
+	conn.CloseNow()
+
+	if conn.Subprotocol() != subprotocol {
+		return fmt.Errorf("server did not accept subprotocol %q", subprotocol)
+	}
+	return nil
+}
+
+// derpNodeURL mirrors the url the WASM client connects to. Custom ports are
+// only honoured to be able to test against local servers.
+func derpNodeURL(node *tailcfg.DERPNode) string {
+	host := node.HostName
+	if node.DERPPort != 0 && node.DERPPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(node.DERPPort))
+	}
+	return (&url.URL{Scheme: "wss", Host: host, Path: "/derp"}).String()
+}
+
+func corsAllows(header http.Header, origin string) bool {
+	allowed := header.Get("Access-Control-Allow-Origin")
+	return allowed == "*" || allowed == origin
+}
+
+func urlOrigin(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+func websocketScheme(scheme string) string {
+	if scheme == "http" {
+		return "ws"
+	}
+	return "wss"
+}
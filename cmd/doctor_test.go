@@ -0,0 +1,372 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// testControlServer stands in for headscale. cors answers preflights for any
+// origin, websockets accepts upgrades on /ts2021.
+func testControlServer(t *testing.T, cors, websockets bool) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/key", func(w http.ResponseWriter, r *http.Request) {
+		if cors {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(tailcfg.OverTLSPublicKeyResponse{PublicKey: key.NewMachine().Public()})
+	})
+	mux.HandleFunc("/ts2021", func(w http.ResponseWriter, r *http.Request) {
+		if !websockets {
+			http.NotFound(w, r)
+			return
+		}
+		acceptWebsocket(w, r, controlWebsocketSubprotocol)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testDERPServer stands in for a DERP node, which browsers always reach over
+// TLS on /derp.
+func testDERPServer(t *testing.T, websockets bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/derp" || !websockets {
+			http.NotFound(w, r)
+			return
+		}
+		acceptWebsocket(w, r, derpWebsocketSubprotocol)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testAssetServer stands in for the console serving config.json.
+func testAssetServer(t *testing.T, status int, contentType, config string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/config.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		w.Write([]byte(config))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func acceptWebsocket(w http.ResponseWriter, r *http.Request, subprotocol string) {
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols:       []string{subprotocol},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// testDoctor returns a doctor for consoleURL whose client trusts any
+// certificate and dials the addresses in hosts instead of the hostnames.
+func testDoctor(t *testing.T, consoleURL, derpMap string, hosts map[string]string) *doctor {
+	t.Helper()
+	dialer := &net.Dialer{}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if target, ok := hosts[addr]; ok {
+			addr = target
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	d, err := newDoctor(&http.Client{Timeout: 5 * time.Second, Transport: transport}, consoleURL, derpMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func writeDERPMap(t *testing.T, derpMap *tailcfg.DERPMap) string {
+	t.Helper()
+	data, err := json.Marshal(derpMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "derp.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testDERPMap(nodes ...*tailcfg.DERPNode) *tailcfg.DERPMap {
+	return &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		900: {RegionID: 900, RegionCode: "test", Nodes: nodes},
+	}}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestDoctorRun(t *testing.T) {
+	control := testControlServer(t, true, true)
+	derp := testDERPServer(t, true)
+	console := testAssetServer(t, http.StatusOK, "application/json", `{"controlUrl": "`+control.URL+`"}`)
+	derpMap := writeDERPMap(t, testDERPMap(&tailcfg.DERPNode{Name: "900a", RegionID: 900, HostName: "derp.test"}))
+
+	d := testDoctor(t, console.URL+"/admin", derpMap, map[string]string{"derp.test:443": derp.Listener.Addr().String()})
+	report := d.run(context.Background())
+
+	if !report.OK {
+		t.Errorf("report not OK: %+v", report.Checks)
+	}
+	if report.ControlURL != control.URL {
+		t.Errorf("ControlURL = %q, want %q", report.ControlURL, control.URL)
+	}
+	wantChecks := []string{"config.json", "control /key", "CORS", "control WebSocket", "DERP map", "DERP region 900 (test)"}
+	if len(report.Checks) != len(wantChecks) {
+		t.Fatalf("got %d checks, want %d: %+v", len(report.Checks), len(wantChecks), report.Checks)
+	}
+	for i, c := range report.Checks {
+		if c.Name != wantChecks[i] || c.Result != doctorPass {
+			t.Errorf("check %d = %s [%s] %s, want %s [pass]", i, c.Name, c.Result, c.Detail, wantChecks[i])
+		}
+	}
+}
+
+func TestDoctorCheckConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		config      string
+		want        string
+		wantControl string
+	}{
+		{"valid", http.StatusOK, "application/json", `{"controlUrl": "https://hs.example.com"}`, doctorPass, "https://hs.example.com"},
+		{"missing", http.StatusNotFound, "text/plain", "", doctorPass, "/"},
+		{"server error", http.StatusInternalServerError, "text/plain", "", doctorFail, "/"},
+		{"wrong content type", http.StatusOK, "text/html", `{}`, doctorFail, "/"},
+		{"invalid", http.StatusOK, "application/json", `{"controlUrl": "ftp://hs"}`, doctorFail, "/"},
+		{"not an object", http.StatusOK, "application/json", `[]`, doctorFail, "/"},
+		{"unknown option", http.StatusOK, "application/json", `{"controlUrl": "https://hs.example.com", "theme": "dark"}`, doctorWarn, "https://hs.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			console := testAssetServer(t, tt.status, tt.contentType, tt.config)
+			d := testDoctor(t, console.URL+"/admin", "", nil)
+
+			controlURL, check := d.checkConfig(context.Background())
+			if check.Result != tt.want {
+				t.Errorf("result = %s (%s), want %s", check.Result, check.Detail, tt.want)
+			}
+			wantControl := tt.wantControl
+			if wantControl == "/" {
+				wantControl = console.URL + "/"
+			}
+			if controlURL == nil || controlURL.String() != wantControl {
+				t.Errorf("controlURL = %v, want %s", controlURL, wantControl)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		console := testAssetServer(t, http.StatusOK, "application/json", `{}`)
+		console.Close()
+		d := testDoctor(t, console.URL+"/admin", "", nil)
+
+		controlURL, check := d.checkConfig(context.Background())
+		if check.Result != doctorFail || controlURL != nil {
+			t.Errorf("got %v, %s; want nil, fail", controlURL, check.Result)
+		}
+	})
+}
+
+func TestDoctorCheckControlKey(t *testing.T) {
+	control := testControlServer(t, false, false)
+	console := testAssetServer(t, http.StatusNotFound, "", "")
+	d := testDoctor(t, console.URL, "", nil)
+
+	tests := []struct {
+		name       string
+		controlURL string
+		want       string
+	}{
+		{"headscale", control.URL, doctorPass},
+		{"console instead of headscale", console.URL, doctorFail},
+		{"wrong path", control.URL + "/admin", doctorFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := d.checkControlKey(context.Background(), mustParseURL(t, tt.controlURL))
+			if check.Result != tt.want {
+				t.Errorf("result = %s (%s), want %s", check.Result, check.Detail, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoctorCheckCORS(t *testing.T) {
+	console := testAssetServer(t, http.StatusNotFound, "", "")
+	d := testDoctor(t, console.URL, "", nil)
+
+	tests := []struct {
+		name       string
+		controlURL string
+		want       string
+	}{
+		{"same origin", console.URL, doctorSkip},
+		{"allowed", testControlServer(t, true, false).URL, doctorPass},
+		{"no headers", testControlServer(t, false, false).URL, doctorFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := d.checkCORS(context.Background(), mustParseURL(t, tt.controlURL))
+			if check.Result != tt.want {
+				t.Errorf("result = %s (%s), want %s", check.Result, check.Detail, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoctorCheckControlWebsocket(t *testing.T) {
+	console := testAssetServer(t, http.StatusNotFound, "", "")
+	d := testDoctor(t, console.URL, "", nil)
+
+	tests := []struct {
+		name       string
+		websockets bool
+		want       string
+	}{
+		{"upgrade accepted", true, doctorPass},
+		{"upgrade rejected", false, doctorFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			control := testControlServer(t, false, tt.websockets)
+			check := d.checkControlWebsocket(context.Background(), mustParseURL(t, control.URL))
+			if check.Result != tt.want {
+				t.Errorf("result = %s (%s), want %s", check.Result, check.Detail, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoctorLoadDERPMap(t *testing.T) {
+	control := testControlServer(t, false, false)
+	node := &tailcfg.DERPNode{Name: "900a", RegionID: 900, HostName: "derp.test"}
+	served := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(testDERPMap(node))
+	}))
+	t.Cleanup(served.Close)
+
+	tests := []struct {
+		name    string
+		derpMap string
+		want    string
+	}{
+		{"file", writeDERPMap(t, testDERPMap(node)), doctorPass},
+		{"url", served.URL, doctorPass},
+		{"not served by control", "", doctorSkip},
+		{"missing file", filepath.Join(t.TempDir(), "missing.json"), doctorFail},
+		{"no regions", writeDERPMap(t, &tailcfg.DERPMap{}), doctorFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDoctor(t, control.URL, tt.derpMap, nil)
+			derpMap, check := d.loadDERPMap(context.Background(), mustParseURL(t, control.URL))
+			if check.Result != tt.want {
+				t.Errorf("result = %s (%s), want %s", check.Result, check.Detail, tt.want)
+			}
+			if (derpMap != nil) != (tt.want == doctorPass) {
+				t.Errorf("derpMap = %v, want one only on pass", derpMap)
+			}
+		})
+	}
+}
+
+func TestDoctorCheckDERPRegions(t *testing.T) {
+	accepting := testDERPServer(t, true).Listener.Addr().String()
+	rejecting := testDERPServer(t, false).Listener.Addr().String()
+	_, portStr, _ := net.SplitHostPort(accepting)
+	acceptingPort, _ := strconv.Atoi(portStr)
+
+	tests := []struct {
+		name  string
+		nodes []*tailcfg.DERPNode
+		want  string
+	}{
+		{"accepting", []*tailcfg.DERPNode{{Name: "a", HostName: "accepting.test"}}, doctorPass},
+		{"falls back to second node", []*tailcfg.DERPNode{
+			{Name: "r", HostName: "rejecting.test"},
+			{Name: "a", HostName: "accepting.test"},
+		}, doctorPass},
+		{"rejecting", []*tailcfg.DERPNode{{Name: "r", HostName: "rejecting.test"}}, doctorFail},
+		{"stun only", []*tailcfg.DERPNode{{Name: "s", HostName: "accepting.test", STUNOnly: true}}, doctorFail},
+		{"custom port", []*tailcfg.DERPNode{{Name: "p", HostName: "127.0.0.1", DERPPort: acceptingPort}}, doctorWarn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDoctor(t, "http://console.test", "", map[string]string{
+				"accepting.test:443": accepting,
+				"rejecting.test:443": rejecting,
+			})
+			checks := d.checkDERPRegions(context.Background(), testDERPMap(tt.nodes...))
+			if len(checks) != 1 {
+				t.Fatalf("got %d checks, want 1", len(checks))
+			}
+			if checks[0].Result != tt.want {
+				t.Errorf("result = %s (%s), want %s", checks[0].Result, checks[0].Detail, tt.want)
+			}
+			if tt.want == doctorFail && checks[0].Hint == "" {
+				t.Errorf("failed check has no hint")
+			}
+		})
+	}
+}
+
+func TestDoctorReportPrint(t *testing.T) {
+	report := doctorReport{OK: true, ConsoleURL: "https://console.example.com"}
+	report.add(doctorCheck{Name: "CORS", Result: doctorFail, Detail: "missing", Hint: "add headers"})
+
+	var b strings.Builder
+	report.print(&b)
+	if report.OK {
+		t.Error("report with a failed check is OK")
+	}
+	for _, want := range []string{"[FAIL] CORS: missing", "hint: add headers", "Problems found"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output misses %q:\n%s", want, b.String())
+		}
+	}
+}
@@ -1,13 +1,43 @@
 package cmd
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	frontend "github.com/rickli-cloud/headscale-console/dist"
+)
+
+// Exit codes of the health command. They allow container orchestrators and
+// scripts to tell an unreachable server from a misbehaving one.
+const (
+	healthExitOK              = 0
+	healthExitUsage           = 1
+	healthExitConnection      = 2
+	healthExitStatus          = 3
+	healthExitContentMismatch = 4
+)
+
+const (
+	healthFailureConnection = "connection"
+	healthFailureStatus     = "status"
+	healthFailureContent    = "content"
 )
 
 func init() {
@@ -20,50 +50,361 @@ func init() {
 	healthCmd.Flags().Int("timeout", 5, "Request timeout in seconds")
 	viper.BindPFlag("health.timeout", healthCmd.Flags().Lookup("timeout"))
 
+	healthCmd.Flags().Int("retries", 0, "Number of additional attempts if a check fails")
+	viper.BindPFlag("health.retries", healthCmd.Flags().Lookup("retries"))
+
+	healthCmd.Flags().Duration("interval", 2*time.Second, "Wait time between attempts")
+	viper.BindPFlag("health.interval", healthCmd.Flags().Lookup("interval"))
+
+	healthCmd.Flags().StringP("output", "o", "text", "Output format (text, json)")
+	viper.BindPFlag("health.output", healthCmd.Flags().Lookup("output"))
+
+	healthCmd.Flags().Bool("check-config", false, "Check that /config.json is served and parses")
+	viper.BindPFlag("health.check-config", healthCmd.Flags().Lookup("check-config"))
+
+	healthCmd.Flags().Bool("check-wasm", false, "Check that the main WASM asset is served as application/wasm")
+	viper.BindPFlag("health.check-wasm", healthCmd.Flags().Lookup("check-wasm"))
+
+	healthCmd.Flags().String("wasm-path", "", "Path of the WASM asset relative to base. Defaults to the embedded tailscale WASM asset")
+	viper.BindPFlag("health.wasm-path", healthCmd.Flags().Lookup("wasm-path"))
+
+	healthCmd.Flags().Bool("insecure", false, "Skip TLS certificate verification")
+	viper.BindPFlag("health.insecure", healthCmd.Flags().Lookup("insecure"))
+
+	healthCmd.Flags().String("ca-file", "", "PEM encoded CA certificates used to verify the server")
+	viper.BindPFlag("health.ca-file", healthCmd.Flags().Lookup("ca-file"))
+
 	rootCmd.AddCommand(healthCmd)
 }
 
 var healthCmd = &cobra.Command{
 	Use:   "health",
 	Short: "Check the healthz endpoint for a 200 OK",
-	Args:  cobra.NoArgs,
+	Long: `Check the healthz endpoint for a 200 OK and optionally verify config.json and the WASM asset.
+
+Exit codes:
+  0  healthy
+  1  invalid usage
+  2  connection failure
+  3  unexpected status code
+  4  content mismatch`,
+	Args: cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		prefix := viper.GetString("health.base")
-		base := viper.GetString("health.host")
-		timeout := viper.GetInt("health.timeout")
+		output := viper.GetString("health.output")
+		if output != "text" && output != "json" {
+			log.Error().Str("output", output).Msg("Invalid output format")
+			os.Exit(healthExitUsage)
+		}
 
-		uri, err := url.JoinPath(base, prefix, "healthz")
+		checker, err := newHealthChecker()
 		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to build URI")
+			log.Error().Err(err).Msg("Invalid health check options")
+			os.Exit(healthExitUsage)
 		}
 
-		client := &http.Client{
-			Timeout: time.Duration(timeout) * time.Second,
+		report := checker.runWithRetries(viper.GetInt("health.retries"), viper.GetDuration("health.interval"))
+		if err := report.write(cmd.OutOrStdout(), output); err != nil {
+			log.Error().Err(err).Msg("Failed to encode report")
+			os.Exit(healthExitUsage)
 		}
 
-		log.Debug().
-			Str("endpoint", uri).
-			Msg("Performing health check")
+		os.Exit(report.exitCode())
+	},
+}
+
+type healthChecker struct {
+	client     *http.Client
+	host       string
+	base       string
+	checkConf  bool
+	checkWasm  bool
+	wasmPath   string
+	wasmLookup error
+}
+
+func newHealthChecker() (*healthChecker, error) {
+	client, err := newHTTPClient(
+		time.Duration(viper.GetInt("health.timeout"))*time.Second,
+		viper.GetBool("health.insecure"),
+		viper.GetString("health.ca-file"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &healthChecker{
+		client:    client,
+		host:      viper.GetString("health.host"),
+		base:      viper.GetString("health.base"),
+		checkConf: viper.GetBool("health.check-config"),
+		checkWasm: viper.GetBool("health.check-wasm"),
+		wasmPath:  viper.GetString("health.wasm-path"),
+	}
 
-		resp, err := client.Get(uri)
+	if c.checkWasm && c.wasmPath == "" {
+		c.wasmPath, c.wasmLookup = findEmbeddedWasm(frontend.Embedded)
+	}
+
+	return c, nil
+}
+
+// newHTTPClient returns a client for probing the console or control server,
+// optionally trusting the CA certificates in caFile.
+func newHTTPClient(timeout time.Duration, insecure bool, caFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
 		if err != nil {
-			log.Fatal().
-				Err(err).
-				Str("uri", uri).
-				Msg("Error connecting to server")
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
 		}
-		defer resp.Body.Close()
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
 
-		if resp.StatusCode != http.StatusOK {
-			log.Fatal().
-				Str("uri", uri).
-				Int("status", resp.StatusCode).
-				Msg("Health check failed")
+// findEmbeddedWasm returns the path of the tailscale WASM module bundled into
+// the frontend, falling back to the first WASM file found.
+func findEmbeddedWasm(fsys fs.FS) (string, error) {
+	var found []string
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && path.Ext(p) == ".wasm" {
+			found = append(found, p)
 		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, p := range found {
+		if strings.HasPrefix(path.Base(p), "tailscale") {
+			return p, nil
+		}
+	}
+	if len(found) > 0 {
+		return found[0], nil
+	}
+	return "", Error("no embedded WASM asset found, use --wasm-path")
+}
 
-		log.Info().
-			Str("uri", uri).
-			Int("status", resp.StatusCode).
-			Msg("Health check successful")
-	},
+type healthReport struct {
+	Healthy  bool                `json:"healthy"`
+	Attempts int                 `json:"attempts"`
+	Checks   []healthCheckResult `json:"checks"`
+}
+
+type healthCheckResult struct {
+	Name     string `json:"name"`
+	URI      string `json:"uri,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Duration string `json:"duration"`
+	OK       bool   `json:"ok"`
+	Failure  string `json:"failure,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// runWithRetries runs the checks until they pass, at most retries+1 times.
+func (c *healthChecker) runWithRetries(retries int, interval time.Duration) healthReport {
+	var report healthReport
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			log.Debug().
+				Int("attempt", attempt+1).
+				Dur("interval", interval).
+				Msg("Retrying health check")
+			time.Sleep(interval)
+		}
+		report = c.run()
+		report.Attempts = attempt + 1
+		if report.Healthy {
+			break
+		}
+	}
+	return report
+}
+
+// write encodes the report to w for the json output, the text output is
+// logged.
+func (r healthReport) write(w io.Writer, output string) error {
+	if output == "json" {
+		return json.NewEncoder(w).Encode(r)
+	}
+	r.log()
+	return nil
+}
+
+func (r healthReport) exitCode() int {
+	// The first failure is the most fundamental one, later checks depend on
+	// the server being reachable at all.
+	for _, c := range r.Checks {
+		switch c.Failure {
+		case healthFailureConnection:
+			return healthExitConnection
+		case healthFailureStatus:
+			return healthExitStatus
+		case healthFailureContent:
+			return healthExitContentMismatch
+		}
+	}
+	return healthExitOK
+}
+
+func (r healthReport) log() {
+	for _, c := range r.Checks {
+		if c.OK {
+			log.Info().
+				Str("check", c.Name).
+				Str("uri", c.URI).
+				Int("status", c.Status).
+				Str("duration", c.Duration).
+				Msg("Health check successful")
+			continue
+		}
+		log.Error().
+			Str("check", c.Name).
+			Str("uri", c.URI).
+			Int("status", c.Status).
+			Str("failure", c.Failure).
+			Str("error", c.Error).
+			Int("attempts", r.Attempts).
+			Msg("Health check failed")
+	}
+}
+
+func (c *healthChecker) run() healthReport {
+	report := healthReport{Healthy: true}
+
+	checks := []struct {
+		name    string
+		path    string
+		enabled bool
+		verify  func(resp *http.Response) error
+	}{
+		{name: "healthz", path: "healthz", enabled: true},
+		{name: "config", path: "config.json", enabled: c.checkConf, verify: verifyHealthConfig},
+		{name: "wasm", path: c.wasmPath, enabled: c.checkWasm, verify: verifyHealthWasm},
+	}
+
+	for _, check := range checks {
+		if !check.enabled {
+			continue
+		}
+		var result healthCheckResult
+		if check.name == "wasm" && c.wasmLookup != nil {
+			result = healthCheckResult{Name: check.name, Failure: healthFailureContent, Error: c.wasmLookup.Error()}
+		} else {
+			result = c.check(check.name, check.path, check.verify)
+		}
+		report.Checks = append(report.Checks, result)
+		if !result.OK {
+			report.Healthy = false
+			// Everything else will fail the same way if the server is down.
+			if result.Failure == healthFailureConnection {
+				break
+			}
+		}
+	}
+
+	return report
+}
+
+func (c *healthChecker) check(name, p string, verify func(*http.Response) error) healthCheckResult {
+	result := healthCheckResult{Name: name}
+	start := time.Now()
+
+	uri, err := url.JoinPath(c.host, c.base, p)
+	if err != nil {
+		result.Failure = healthFailureConnection
+		result.Error = err.Error()
+		result.Duration = time.Since(start).String()
+		return result
+	}
+	result.URI = uri
+
+	log.Debug().
+		Str("check", name).
+		Str("endpoint", uri).
+		Msg("Performing health check")
+
+	resp, err := c.client.Get(uri)
+	if err != nil {
+		result.Failure = healthFailureConnection
+		result.Error = err.Error()
+		result.Duration = time.Since(start).String()
+		return result
+	}
+	defer resp.Body.Close()
+	result.Status = resp.StatusCode
+
+	if resp.StatusCode != http.StatusOK {
+		result.Failure = healthFailureStatus
+		result.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		result.Duration = time.Since(start).String()
+		return result
+	}
+
+	if verify != nil {
+		if err := verify(resp); err != nil {
+			result.Failure = healthFailureContent
+			result.Error = err.Error()
+		}
+	}
+
+	result.OK = result.Failure == ""
+	result.Duration = time.Since(start).String()
+	return result
+}
+
+func verifyHealthConfig(resp *http.Response) error {
+	if err := verifyHealthContentType(resp, "application/json"); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading config.json: %v", err)
+	}
+	var config map[string]any
+	if err := json.Unmarshal(body, &config); err != nil {
+		return fmt.Errorf("config.json does not parse: %v", err)
+	}
+	return nil
+}
+
+// wasmMagic is the preamble every WebAssembly binary starts with.
+var wasmMagic = []byte{0x00, 'a', 's', 'm'}
+
+// verifyHealthWasm only reads the magic, not the whole module.
+func verifyHealthWasm(resp *http.Response) error {
+	if err := verifyHealthContentType(resp, "application/wasm"); err != nil {
+		return err
+	}
+	magic := make([]byte, len(wasmMagic))
+	if _, err := io.ReadFull(io.LimitReader(resp.Body, int64(len(magic))), magic); err != nil || !bytes.Equal(magic, wasmMagic) {
+		return errors.New("response is not a WASM module")
+	}
+	return nil
+}
+
+func verifyHealthContentType(resp *http.Response, want string) error {
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != want {
+		return fmt.Errorf("unexpected content type %q, expected %s", contentType, want)
+	}
+	return nil
 }
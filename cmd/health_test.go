@@ -0,0 +1,230 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testHealthServer serves healthz, config.json and the WASM asset below
+// /admin. healthz answers with 503 to its first failures requests.
+func testHealthServer(t *testing.T, failures int, config, wasmType string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if int(requests.Add(1)) <= failures {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/admin/config.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(config))
+	})
+	mux.HandleFunc("/admin/tailscale.wasm", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", wasmType)
+		w.Write([]byte("\x00asm\x01\x00\x00\x00"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func testHealthChecker(host string) *healthChecker {
+	return &healthChecker{
+		client:    &http.Client{Timeout: 5 * time.Second},
+		host:      host,
+		base:      "/admin",
+		checkConf: true,
+		checkWasm: true,
+		wasmPath:  "tailscale.wasm",
+	}
+}
+
+func TestHealthExitCodes(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name        string
+		host        func(t *testing.T) string
+		wantCode    int
+		wantFailure string
+		wantChecks  int
+	}{
+		{
+			name: "healthy",
+			host: func(t *testing.T) string {
+				srv, _ := testHealthServer(t, 0, `{"logLevel": "INFO"}`, "application/wasm")
+				return srv.URL
+			},
+			wantCode:   healthExitOK,
+			wantChecks: 3,
+		},
+		{
+			name:        "connection",
+			host:        func(t *testing.T) string { return closed.URL },
+			wantCode:    healthExitConnection,
+			wantFailure: healthFailureConnection,
+			// The other checks would fail the same way.
+			wantChecks: 1,
+		},
+		{
+			name: "status",
+			host: func(t *testing.T) string {
+				srv, _ := testHealthServer(t, 1, `{}`, "application/wasm")
+				return srv.URL
+			},
+			wantCode:    healthExitStatus,
+			wantFailure: healthFailureStatus,
+			wantChecks:  3,
+		},
+		{
+			name: "invalid config",
+			host: func(t *testing.T) string {
+				srv, _ := testHealthServer(t, 0, `{"logLevel": }`, "application/wasm")
+				return srv.URL
+			},
+			wantCode:    healthExitContentMismatch,
+			wantFailure: healthFailureContent,
+			wantChecks:  3,
+		},
+		{
+			name: "wasm content type",
+			host: func(t *testing.T) string {
+				srv, _ := testHealthServer(t, 0, `{}`, "text/html")
+				return srv.URL
+			},
+			wantCode:    healthExitContentMismatch,
+			wantFailure: healthFailureContent,
+			wantChecks:  3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := testHealthChecker(tt.host(t)).run()
+			if got := report.exitCode(); got != tt.wantCode {
+				t.Errorf("exitCode = %d, want %d: %+v", got, tt.wantCode, report.Checks)
+			}
+			if report.Healthy != (tt.wantCode == healthExitOK) {
+				t.Errorf("healthy = %v, want %v", report.Healthy, tt.wantCode == healthExitOK)
+			}
+			if len(report.Checks) != tt.wantChecks {
+				t.Fatalf("got %d checks, want %d: %+v", len(report.Checks), tt.wantChecks, report.Checks)
+			}
+			if tt.wantFailure == "" {
+				return
+			}
+			failed := false
+			for _, c := range report.Checks {
+				failed = failed || c.Failure == tt.wantFailure
+			}
+			if !failed {
+				t.Errorf("no check failed with %s: %+v", tt.wantFailure, report.Checks)
+			}
+		})
+	}
+}
+
+func TestHealthRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		retries      int
+		wantHealthy  bool
+		wantAttempts int
+	}{
+		{"healthy at once", 0, 2, true, 1},
+		{"healthy after retries", 2, 2, true, 3},
+		{"retries exhausted", 3, 2, false, 3},
+		{"no retries", 1, 0, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := testHealthServer(t, tt.failures, `{}`, "application/wasm")
+			c := testHealthChecker(srv.URL)
+			c.checkConf, c.checkWasm = false, false
+
+			const interval = 20 * time.Millisecond
+			start := time.Now()
+			report := c.runWithRetries(tt.retries, interval)
+
+			if report.Healthy != tt.wantHealthy || report.Attempts != tt.wantAttempts {
+				t.Errorf("healthy = %v after %d attempts, want %v after %d", report.Healthy, report.Attempts, tt.wantHealthy, tt.wantAttempts)
+			}
+			if got := int(requests.Load()); got != tt.wantAttempts {
+				t.Errorf("server got %d requests, want %d", got, tt.wantAttempts)
+			}
+			if spacing := time.Duration(tt.wantAttempts-1) * interval; time.Since(start) < spacing {
+				t.Errorf("attempts were not spaced by the interval")
+			}
+		})
+	}
+}
+
+func TestHealthJSONOutput(t *testing.T) {
+	srv, _ := testHealthServer(t, 0, `{"logLevel": }`, "application/wasm")
+	report := testHealthChecker(srv.URL).runWithRetries(0, 0)
+
+	var b strings.Builder
+	if err := report.write(&b, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Healthy  bool `json:"healthy"`
+		Attempts int  `json:"attempts"`
+		Checks   []struct {
+			Name    string `json:"name"`
+			URI     string `json:"uri"`
+			Status  int    `json:"status"`
+			OK      bool   `json:"ok"`
+			Failure string `json:"failure"`
+		} `json:"checks"`
+	}
+	if err := json.Unmarshal([]byte(b.String()), &got); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, b.String())
+	}
+	if got.Healthy || got.Attempts != 1 || len(got.Checks) != 3 {
+		t.Fatalf("report = %+v", got)
+	}
+	config := got.Checks[1]
+	if config.Name != "config" || config.URI != srv.URL+"/admin/config.json" || config.Status != http.StatusOK || config.OK || config.Failure != healthFailureContent {
+		t.Errorf("config check = %+v", config)
+	}
+}
+
+func TestVerifyHealthWasm(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{name: "module", body: "\x00asm\x01\x00\x00\x00"},
+		{name: "html", body: "<!doctype html>", wantErr: true},
+		{name: "short", body: "\x00as", wantErr: true},
+		{name: "empty", body: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.NewReader(tt.body)
+			resp := &http.Response{
+				Header: http.Header{"Content-Type": []string{"application/wasm"}},
+				Body:   io.NopCloser(body),
+			}
+			err := verifyHealthWasm(resp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyHealthWasm = %v, want error %v", err, tt.wantErr)
+			}
+			if read := len(tt.body) - body.Len(); read > len(wasmMagic) {
+				t.Errorf("read %d bytes, want at most %d", read, len(wasmMagic))
+			}
+		})
+	}
+}
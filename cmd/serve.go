@@ -2,9 +2,7 @@ package cmd
 
 import (
 	"context"
-	"encoding/json"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/google/uuid"
@@ -25,6 +23,18 @@ func init() {
 	serveCmd.Flags().String("configfile", "", "Path to optional config file. Required if provided, otherwise will check config.json if it exists.")
 	viper.BindPFlag("serve.configfile", serveCmd.Flags().Lookup("configfile"))
 
+	serveCmd.Flags().String("connections", "", "Path to optional connection presets file (YAML or JSON) served at /connections.json")
+	viper.BindPFlag("serve.connections", serveCmd.Flags().Lookup("connections"))
+
+	serveCmd.Flags().String("connections-groups-header", "", "Request header containing the comma separated groups of the authenticated user, set by an authenticating reverse proxy. Presets with groups are hidden if unset")
+	viper.BindPFlag("serve.connections-groups-header", serveCmd.Flags().Lookup("connections-groups-header"))
+
+	serveCmd.Flags().String("webhooks", "", "Path to optional webhooks file (YAML or JSON) notified about session events reported to /events")
+	viper.BindPFlag("serve.webhooks", serveCmd.Flags().Lookup("webhooks"))
+
+	serveCmd.Flags().String("webhooks-user-header", "", "Request header containing the authenticated user, set by an authenticating reverse proxy. Required with --webhooks")
+	viper.BindPFlag("serve.webhooks-user-header", serveCmd.Flags().Lookup("webhooks-user-header"))
+
 	rootCmd.AddCommand(serveCmd)
 }
 
@@ -36,31 +46,80 @@ var serveCmd = &cobra.Command{
 		prefix := viper.GetString("serve.base")
 		listenAddr := viper.GetString("serve.listen")
 		configfile := viper.GetString("serve.configfile")
-
-		var config []byte
+		connectionsfile := viper.GetString("serve.connections")
+		groupsHeader := viper.GetString("serve.connections-groups-header")
+		webhooksfile := viper.GetString("serve.webhooks")
+		userHeader := viper.GetString("serve.webhooks-user-header")
 
 		allowConfigNotExists := configfile == ""
 		if configfile == "" {
-			configfile = "config.json"
+			configfile = defaultConfigFile
 			log.Info().Msg("Checking for config in default config.json location")
 		}
 
-		config, err := os.ReadFile(configfile)
-		if err != nil {
-			if os.IsNotExist(err) && allowConfigNotExists {
-				log.Info().Msg("Ignoring missing config file from default path")
-			} else {
-				log.Fatal().Err(err).Msg("Failed to read configfile")
+		config, errs := loadConfigFile(configfile, allowConfigNotExists)
+		unknown, errs := splitUnknownOptions(errs)
+		for _, err := range unknown {
+			log.Warn().Str("configfile", configfile).Msg(err.Error())
+		}
+		if len(errs) > 0 {
+			for _, err := range errs {
+				log.Error().Str("configfile", configfile).Msg(err.Error())
 			}
+			log.Fatal().
+				Str("configfile", configfile).
+				Err(errConfigInvalid).
+				Msg("Failed to load configfile")
+		}
+
+		if config == nil {
+			log.Info().Msg("Ignoring missing config file from default path")
 		} else {
-			if err := json.Unmarshal(config, &map[string]any{}); err != nil {
+			log.Info().Str("configfile", configfile).Msg("Loaded config")
+		}
+
+		var connections *connectionsFile
+		if connectionsfile != "" {
+			connections, errs = loadConnectionsFile(connectionsfile)
+			if len(errs) > 0 {
+				for _, err := range errs {
+					log.Error().Str("connections", connectionsfile).Msg(err.Error())
+				}
 				log.Fatal().
-					Str("configfile", configfile).
-					Err(err).
-					Msg("Failed to parse configfile")
+					Str("connections", connectionsfile).
+					Err(errConfigInvalid).
+					Msg("Failed to load connections")
 			}
 
-			log.Info().Str("configfile", configfile).Msg("Loaded config")
+			log.Info().
+				Str("connections", connectionsfile).
+				Int("presets", len(connections.Connections)).
+				Msg("Loaded connections")
+		}
+
+		var notifier *webhookNotifier
+		if webhooksfile != "" {
+			if userHeader == "" {
+				log.Fatal().
+					Str("webhooks", webhooksfile).
+					Msg("--webhooks requires --webhooks-user-header, session events are only accepted from authenticated users")
+			}
+
+			notifier, errs = loadWebhooksFile(webhooksfile)
+			if len(errs) > 0 {
+				for _, err := range errs {
+					log.Error().Str("webhooks", webhooksfile).Msg(err.Error())
+				}
+				log.Fatal().
+					Str("webhooks", webhooksfile).
+					Err(errConfigInvalid).
+					Msg("Failed to load webhooks")
+			}
+
+			log.Info().
+				Str("webhooks", webhooksfile).
+				Int("count", len(notifier.hooks)).
+				Msg("Loaded webhooks")
 		}
 
 		router := http.NewServeMux()
@@ -85,6 +144,14 @@ var serveCmd = &cobra.Command{
 			})
 		}
 
+		if connections != nil {
+			subrouter.HandleFunc("/connections.json", connections.handler(groupsHeader))
+		}
+
+		if notifier != nil {
+			subrouter.HandleFunc("/events", notifier.sessionEventHandler(userHeader))
+		}
+
 		subrouter.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "text/plain")
 			_, err := w.Write([]byte("OK"))
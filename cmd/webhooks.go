@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Session events reported by clients to /events.
+const (
+	sessionEventStart = "session.start"
+	sessionEventEnd   = "session.end"
+)
+
+const (
+	webhookFormatJSON  = "json"
+	webhookFormatSlack = "slack"
+	webhookFormatNtfy  = "ntfy"
+)
+
+const (
+	defaultWebhookRetries        = 3
+	defaultWebhookTimeoutSeconds = 10
+	webhookInitialBackoff        = time.Second
+	webhookSignatureHeader       = "X-Headscale-Console-Signature"
+	webhookEventHeader           = "X-Headscale-Console-Event"
+	maxSessionEventBytes         = 16 << 10
+)
+
+const defaultWebhookMessage = `{{if .User}}{{.User}}{{else}}Someone{{end}} {{if eq .Type "session.start"}}opened{{else}}closed{{end}} a {{.Protocol}} session to {{.Peer}}{{if .Username}} as {{.Username}}{{end}}`
+
+var sessionEventTypes = []string{sessionEventStart, sessionEventEnd}
+
+type webhooksFile struct {
+	Webhooks []webhookConfig `json:"webhooks" yaml:"webhooks"`
+}
+
+type webhookConfig struct {
+	Name   string `json:"name" yaml:"name"`
+	URL    string `json:"url" yaml:"url"`
+	Format string `json:"format" yaml:"format"`
+	// Events limits the webhook to some event types, all if empty.
+	Events []string `json:"events" yaml:"events"`
+	// Tags limits the webhook to sessions to peers with one of the tags.
+	Tags []string `json:"tags" yaml:"tags"`
+	// Template is a text/template rendered with the sessionEvent. It
+	// replaces the request body for json and the message for slack and ntfy.
+	Template string `json:"template" yaml:"template"`
+	// Secret enables HMAC-SHA256 signing of the request body.
+	Secret         string            `json:"secret" yaml:"secret"`
+	Headers        map[string]string `json:"headers" yaml:"headers"`
+	Retries        *int              `json:"retries" yaml:"retries"`
+	TimeoutSeconds int               `json:"timeoutSeconds" yaml:"timeoutSeconds"`
+}
+
+// sessionEventReport is the body the frontend posts to /events whenever an
+// interactive session is opened or closed.
+type sessionEventReport struct {
+	Type     string   `json:"type"`
+	Protocol string   `json:"protocol"`
+	Peer     string   `json:"peer"`
+	PeerTags []string `json:"peerTags,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	Username string   `json:"username,omitempty"`
+}
+
+// sessionEvent is a sessionEventReport completed by the server. User is the
+// authenticated user, Peer, PeerTags, Address and Username are client
+// provided.
+type sessionEvent struct {
+	Type     string    `json:"type"`
+	Protocol string    `json:"protocol"`
+	Peer     string    `json:"peer"`
+	PeerTags []string  `json:"peerTags,omitempty"`
+	Address  string    `json:"address,omitempty"`
+	Username string    `json:"username,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote,omitempty"`
+}
+
+func (e sessionEvent) validate() error {
+	if !slices.Contains(sessionEventTypes, e.Type) {
+		return fmt.Errorf("invalid type %q, expected one of %s", e.Type, strings.Join(sessionEventTypes, ", "))
+	}
+	if _, ok := connectionProtocolPorts[e.Protocol]; !ok {
+		return fmt.Errorf("invalid protocol %q", e.Protocol)
+	}
+	if e.Peer == "" {
+		return Error("peer is required")
+	}
+	return nil
+}
+
+type webhook struct {
+	webhookConfig
+	template *template.Template
+	retries  int
+}
+
+// webhookNotifier delivers session events to the configured webhooks.
+type webhookNotifier struct {
+	client  *http.Client
+	hooks   []*webhook
+	backoff time.Duration
+}
+
+// loadWebhooksFile reads and validates a webhooks file. YAML is used for .yaml
+// and .yml files, JSON otherwise.
+func loadWebhooksFile(path string) (*webhookNotifier, []error) {
+	var file webhooksFile
+	if err := decodeConfigFile(path, &file); err != nil {
+		return nil, []error{err}
+	}
+
+	return newWebhookNotifier(http.DefaultClient, file.Webhooks)
+}
+
+func newWebhookNotifier(client *http.Client, configs []webhookConfig) (*webhookNotifier, []error) {
+	n := &webhookNotifier{client: client, backoff: webhookInitialBackoff}
+
+	var errs []error
+	for i, c := range configs {
+		path := fmt.Sprintf("webhooks[%d]", i)
+		if c.Name == "" {
+			c.Name = path
+		}
+
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, configErrorf(path+".url", "invalid url %q", c.URL))
+		}
+
+		if c.Format == "" {
+			c.Format = webhookFormatJSON
+		}
+		if c.Format != webhookFormatJSON && c.Format != webhookFormatSlack && c.Format != webhookFormatNtfy {
+			errs = append(errs, configErrorf(path+".format", "invalid value %q, expected one of json, slack, ntfy", c.Format))
+		}
+
+		for j, event := range c.Events {
+			if !slices.Contains(sessionEventTypes, event) {
+				errs = append(errs, configErrorf(fmt.Sprintf("%s.events[%d]", path, j), "invalid value %q, expected one of %s", event, strings.Join(sessionEventTypes, ", ")))
+			}
+		}
+		for j, tag := range c.Tags {
+			if err := validateTag(tag); err != nil {
+				errs = append(errs, configErrorf(fmt.Sprintf("%s.tags[%d]", path, j), "%v", err))
+			}
+		}
+
+		hook := &webhook{webhookConfig: c, retries: defaultWebhookRetries}
+		if c.Retries != nil {
+			if *c.Retries < 0 {
+				errs = append(errs, configErrorf(path+".retries", "must not be negative"))
+			}
+			hook.retries = *c.Retries
+		}
+		if c.TimeoutSeconds < 0 {
+			errs = append(errs, configErrorf(path+".timeoutSeconds", "must not be negative"))
+		} else if c.TimeoutSeconds == 0 {
+			hook.TimeoutSeconds = defaultWebhookTimeoutSeconds
+		}
+
+		tmpl := c.Template
+		if tmpl == "" && c.Format != webhookFormatJSON {
+			tmpl = defaultWebhookMessage
+		}
+		if tmpl != "" {
+			t, err := template.New(c.Name).Option("missingkey=error").Parse(tmpl)
+			if err != nil {
+				errs = append(errs, configErrorf(path+".template", "%v", err))
+			}
+			hook.template = t
+		}
+
+		n.hooks = append(n.hooks, hook)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return n, nil
+}
+
+func (h *webhook) matches(ev sessionEvent) bool {
+	if len(h.Events) > 0 && !slices.Contains(h.Events, ev.Type) {
+		return false
+	}
+	if len(h.Tags) > 0 && !slices.ContainsFunc(ev.PeerTags, func(t string) bool { return slices.Contains(h.Tags, t) }) {
+		return false
+	}
+	return true
+}
+
+// notify delivers ev to every matching webhook in the background.
+func (n *webhookNotifier) notify(ev sessionEvent) {
+	for _, hook := range n.hooks {
+		if !hook.matches(ev) {
+			continue
+		}
+		go func() {
+			if err := n.deliver(context.Background(), hook, ev); err != nil {
+				log.Error().
+					Err(err).
+					Str("webhook", hook.Name).
+					Str("event", ev.Type).
+					Str("peer", ev.Peer).
+					Msg("Failed to deliver webhook")
+			}
+		}()
+	}
+}
+
+// deliver sends ev to hook, retrying with exponential backoff on connection
+// errors and non 2xx responses.
+func (n *webhookNotifier) deliver(ctx context.Context, hook *webhook, ev sessionEvent) error {
+	body, contentType, err := hook.render(ev)
+	if err != nil {
+		return err
+	}
+
+	backoff := n.backoff
+	for attempt := 0; ; attempt++ {
+		err = n.send(ctx, hook, ev, body, contentType)
+		if err == nil {
+			log.Debug().
+				Str("webhook", hook.Name).
+				Str("event", ev.Type).
+				Int("attempt", attempt+1).
+				Msg("Delivered webhook")
+			return nil
+		}
+		if attempt >= hook.retries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+
+		log.Warn().
+			Err(err).
+			Str("webhook", hook.Name).
+			Int("attempt", attempt+1).
+			Dur("backoff", backoff).
+			Msg("Webhook delivery failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (n *webhookNotifier) send(ctx context.Context, hook *webhook, ev sessionEvent, body []byte, contentType string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(hook.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "headscale-console")
+	req.Header.Set(webhookEventHeader, ev.Type)
+	if hook.Format == webhookFormatNtfy {
+		req.Header.Set("Title", "headscale-console: "+ev.Type)
+		req.Header.Set("Tags", ev.Protocol)
+	}
+	for k, v := range hook.Headers {
+		req.Header.Set(k, v)
+	}
+	if hook.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookBody(hook.Secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// render returns the request body and content type for ev.
+func (h *webhook) render(ev sessionEvent) ([]byte, string, error) {
+	var message string
+	if h.template != nil {
+		var b strings.Builder
+		if err := h.template.Execute(&b, ev); err != nil {
+			return nil, "", fmt.Errorf("render template: %w", err)
+		}
+		message = b.String()
+	}
+
+	switch h.Format {
+	case webhookFormatSlack:
+		body, err := json.Marshal(map[string]string{"text": message})
+		return body, "application/json", err
+	case webhookFormatNtfy:
+		return []byte(message), "text/plain; charset=utf-8", nil
+	default:
+		if h.template != nil {
+			if !json.Valid([]byte(message)) {
+				return nil, "", Error("template did not render valid JSON")
+			}
+			return []byte(message), "application/json", nil
+		}
+		body, err := json.Marshal(ev)
+		return body, "application/json", err
+	}
+}
+
+// signWebhookBody returns the hex encoded HMAC-SHA256 of body, receivers
+// verify it against the X-Headscale-Console-Signature header.
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sessionEventHandler accepts session events from clients and hands them to
+// the notifier. The user is read from userHeader, set by an authenticating
+// reverse proxy, events without it are rejected.
+func (n *webhookNotifier) sessionEventHandler(userHeader string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user := strings.TrimSpace(r.Header.Get(userHeader))
+		if user == "" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+
+		var report sessionEventReport
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSessionEventBytes))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&report); err != nil {
+			http.Error(w, "invalid event: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ev := sessionEvent{
+			Type:     report.Type,
+			Protocol: report.Protocol,
+			Peer:     report.Peer,
+			PeerTags: report.PeerTags,
+			Address:  report.Address,
+			Username: report.Username,
+			User:     user,
+			Time:     time.Now().UTC(),
+			Remote:   r.RemoteAddr,
+		}
+		if err := ev.validate(); err != nil {
+			http.Error(w, "invalid event: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Info().
+			Str("requestId", r.Context().Value("requestId").(string)).
+			Str("event", ev.Type).
+			Str("protocol", ev.Protocol).
+			Str("peer", ev.Peer).
+			Str("user", ev.User).
+			Msg("Session event")
+
+		n.notify(ev)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,372 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a request captured by testReceiver.
+type webhookRequest struct {
+	Header http.Header
+	Body   []byte
+}
+
+// testReceiver is a local webhook receiver answering with the given status
+// codes in order, 200 once they are used up.
+type testReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []webhookRequest
+	received chan struct{}
+}
+
+func newTestReceiver(t *testing.T, statuses ...int) *testReceiver {
+	t.Helper()
+	r := &testReceiver{statuses: statuses, received: make(chan struct{}, 16)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		r.mu.Lock()
+		r.requests = append(r.requests, webhookRequest{Header: req.Header.Clone(), Body: body})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+
+		w.WriteHeader(status)
+		r.received <- struct{}{}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testReceiver) captured() []webhookRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]webhookRequest(nil), r.requests...)
+}
+
+func testNotifier(t *testing.T, configs ...webhookConfig) *webhookNotifier {
+	t.Helper()
+	n, errs := newWebhookNotifier(http.DefaultClient, configs)
+	if len(errs) > 0 {
+		t.Fatalf("invalid webhooks: %v", errs)
+	}
+	n.backoff = time.Millisecond
+	return n
+}
+
+func testSessionEvent() sessionEvent {
+	return sessionEvent{
+		Type:     sessionEventStart,
+		Protocol: "ssh",
+		Peer:     "db1",
+		PeerTags: []string{"tag:prod"},
+		Address:  "100.64.0.5",
+		Username: "root",
+		User:     "alice@example.com",
+		Time:     time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestWebhookFormats(t *testing.T) {
+	tests := []struct {
+		name            string
+		format          string
+		template        string
+		wantContentType string
+		wantBody        func(t *testing.T, body []byte)
+	}{
+		{
+			name:            "json",
+			format:          webhookFormatJSON,
+			wantContentType: "application/json",
+			wantBody: func(t *testing.T, body []byte) {
+				var ev sessionEvent
+				if err := json.Unmarshal(body, &ev); err != nil {
+					t.Fatal(err)
+				}
+				if ev.Peer != "db1" || ev.User != "alice@example.com" || ev.Type != sessionEventStart {
+					t.Errorf("unexpected event %+v", ev)
+				}
+			},
+		},
+		{
+			name:            "json template",
+			format:          webhookFormatJSON,
+			template:        `{"who": "{{.User}}", "where": "{{.Peer}}"}`,
+			wantContentType: "application/json",
+			wantBody: func(t *testing.T, body []byte) {
+				if got, want := string(body), `{"who": "alice@example.com", "where": "db1"}`; got != want {
+					t.Errorf("body = %s, want %s", got, want)
+				}
+			},
+		},
+		{
+			name:            "slack",
+			format:          webhookFormatSlack,
+			wantContentType: "application/json",
+			wantBody: func(t *testing.T, body []byte) {
+				var msg map[string]string
+				if err := json.Unmarshal(body, &msg); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := msg["text"], "alice@example.com opened a ssh session to db1 as root"; got != want {
+					t.Errorf("text = %q, want %q", got, want)
+				}
+			},
+		},
+		{
+			name:            "ntfy",
+			format:          webhookFormatNtfy,
+			template:        "{{.User}} connected to {{.Peer}} ({{.Protocol}})",
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody: func(t *testing.T, body []byte) {
+				if got, want := string(body), "alice@example.com connected to db1 (ssh)"; got != want {
+					t.Errorf("body = %q, want %q", got, want)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newTestReceiver(t)
+			n := testNotifier(t, webhookConfig{
+				URL:      receiver.URL,
+				Format:   tt.format,
+				Template: tt.template,
+				Headers:  map[string]string{"Authorization": "Bearer xxx"},
+			})
+
+			if err := n.deliver(context.Background(), n.hooks[0], testSessionEvent()); err != nil {
+				t.Fatal(err)
+			}
+			requests := receiver.captured()
+			if len(requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(requests))
+			}
+			req := requests[0]
+			if got := req.Header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if got := req.Header.Get(webhookEventHeader); got != sessionEventStart {
+				t.Errorf("%s = %q, want %q", webhookEventHeader, got, sessionEventStart)
+			}
+			if got := req.Header.Get("Authorization"); got != "Bearer xxx" {
+				t.Errorf("Authorization = %q, want custom header", got)
+			}
+			if tt.format == webhookFormatNtfy && req.Header.Get("Title") == "" {
+				t.Errorf("ntfy request without Title")
+			}
+			tt.wantBody(t, req.Body)
+		})
+	}
+}
+
+func TestWebhookInvalidJSONTemplate(t *testing.T) {
+	receiver := newTestReceiver(t)
+	n := testNotifier(t, webhookConfig{URL: receiver.URL, Template: `{"peer": {{.Peer}}}`})
+
+	err := n.deliver(context.Background(), n.hooks[0], testSessionEvent())
+	if err == nil || !strings.Contains(err.Error(), "valid JSON") {
+		t.Errorf("err = %v, want invalid JSON error", err)
+	}
+	if got := len(receiver.captured()); got != 0 {
+		t.Errorf("got %d requests, want none", got)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	receiver := newTestReceiver(t)
+	n := testNotifier(t,
+		webhookConfig{URL: receiver.URL, Secret: "change-me"},
+		webhookConfig{URL: receiver.URL},
+	)
+
+	for _, hook := range n.hooks {
+		if err := n.deliver(context.Background(), hook, testSessionEvent()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	requests := receiver.captured()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+
+	signed := requests[0]
+	if got, want := signed.Header.Get(webhookSignatureHeader), "sha256="+signWebhookBody("change-me", signed.Body); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if got := signWebhookBody("other", signed.Body); "sha256="+got == signed.Header.Get(webhookSignatureHeader) {
+		t.Errorf("signature does not depend on the secret")
+	}
+	if got := requests[1].Header.Get(webhookSignatureHeader); got != "" {
+		t.Errorf("unsigned webhook sent signature %q", got)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	retries := func(n int) *int { return &n }
+
+	tests := []struct {
+		name         string
+		statuses     []int
+		retries      int
+		wantErr      bool
+		wantRequests int
+	}{
+		{"delivered after 5xx", []int{http.StatusBadGateway, http.StatusServiceUnavailable}, 3, false, 3},
+		{"gives up", []int{500, 500, 500}, 2, true, 3},
+		{"no retries", []int{500}, 0, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newTestReceiver(t, tt.statuses...)
+			n := testNotifier(t, webhookConfig{URL: receiver.URL, Retries: retries(tt.retries)})
+
+			err := n.deliver(context.Background(), n.hooks[0], testSessionEvent())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := len(receiver.captured()); got != tt.wantRequests {
+				t.Errorf("got %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+
+	t.Run("backoff doubles", func(t *testing.T) {
+		receiver := newTestReceiver(t, 500, 500, 500)
+		n := testNotifier(t, webhookConfig{URL: receiver.URL})
+		n.backoff = 20 * time.Millisecond
+
+		start := time.Now()
+		if err := n.deliver(context.Background(), n.hooks[0], testSessionEvent()); err != nil {
+			t.Fatal(err)
+		}
+		// 20ms + 40ms + 80ms
+		if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+			t.Errorf("delivered after %v, want at least 140ms of backoff", elapsed)
+		}
+	})
+}
+
+func TestWebhookFilters(t *testing.T) {
+	tests := []struct {
+		name   string
+		config webhookConfig
+		event  func(ev *sessionEvent)
+		want   bool
+	}{
+		{"all events", webhookConfig{}, func(ev *sessionEvent) {}, true},
+		{"event matches", webhookConfig{Events: []string{sessionEventStart}}, func(ev *sessionEvent) {}, true},
+		{"event filtered", webhookConfig{Events: []string{sessionEventStart}}, func(ev *sessionEvent) { ev.Type = sessionEventEnd }, false},
+		{"tag matches", webhookConfig{Tags: []string{"tag:dev", "tag:prod"}}, func(ev *sessionEvent) {}, true},
+		{"tag filtered", webhookConfig{Tags: []string{"tag:dev"}}, func(ev *sessionEvent) {}, false},
+		{"untagged peer", webhookConfig{Tags: []string{"tag:prod"}}, func(ev *sessionEvent) { ev.PeerTags = nil }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newTestReceiver(t)
+			tt.config.URL = receiver.URL
+			n := testNotifier(t, tt.config)
+
+			ev := testSessionEvent()
+			tt.event(&ev)
+			if got := n.hooks[0].matches(ev); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+
+			n.notify(ev)
+			select {
+			case <-receiver.received:
+				if !tt.want {
+					t.Errorf("filtered event was delivered")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.want {
+					t.Errorf("event was not delivered")
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookConfigValidation(t *testing.T) {
+	negative := -1
+	_, errs := newWebhookNotifier(http.DefaultClient, []webhookConfig{
+		{URL: "ftp://example.com"},
+		{URL: "https://example.com", Format: "teams"},
+		{URL: "https://example.com", Events: []string{"session.open"}},
+		{URL: "https://example.com", Tags: []string{"prod"}},
+		{URL: "https://example.com", Retries: &negative},
+		{URL: "https://example.com", Template: "{{.Peer"},
+	})
+	if len(errs) != 6 {
+		t.Errorf("got %d errors, want 6: %v", len(errs), errs)
+	}
+}
+
+func TestSessionEventHandler(t *testing.T) {
+	const userHeader = "X-Forwarded-User"
+	validBody := `{"type": "session.start", "protocol": "ssh", "peer": "db1", "peerTags": ["tag:prod"]}`
+
+	tests := []struct {
+		name       string
+		method     string
+		user       string
+		body       string
+		wantStatus int
+		wantUser   string
+	}{
+		{"accepted", http.MethodPost, "alice@example.com", validBody, http.StatusAccepted, "alice@example.com"},
+		{"unauthenticated", http.MethodPost, "", validBody, http.StatusUnauthorized, ""},
+		{"client provided user", http.MethodPost, "alice@example.com", `{"type": "session.start", "protocol": "ssh", "peer": "db1", "user": "mallory"}`, http.StatusBadRequest, ""},
+		{"invalid type", http.MethodPost, "alice@example.com", `{"type": "session.open", "protocol": "ssh", "peer": "db1"}`, http.StatusBadRequest, ""},
+		{"missing peer", http.MethodPost, "alice@example.com", `{"type": "session.end", "protocol": "ssh"}`, http.StatusBadRequest, ""},
+		{"wrong method", http.MethodGet, "alice@example.com", "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newTestReceiver(t)
+			n := testNotifier(t, webhookConfig{URL: receiver.URL})
+			handler := newLoggingMiddleware(n.sessionEventHandler(userHeader))
+
+			req := httptest.NewRequest(tt.method, "/events", strings.NewReader(tt.body))
+			if tt.user != "" {
+				req.Header.Set(userHeader, tt.user)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Body.String(), tt.wantStatus)
+			}
+			if tt.wantUser == "" {
+				return
+			}
+
+			select {
+			case <-receiver.received:
+			case <-time.After(time.Second):
+				t.Fatal("event was not delivered")
+			}
+			var ev sessionEvent
+			if err := json.Unmarshal(receiver.captured()[0].Body, &ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.User != tt.wantUser || ev.Time.IsZero() || ev.Remote == "" {
+				t.Errorf("event not completed by the server: %+v", ev)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ import { IpnStateStorage } from "$lib/store/ipn";
 import wasmUrl from "./pkg/tailscale.wasm?url";
 import "./pkg/wasm_exec";
 
+import { installMemoryFS } from "./memfs";
+
 import "./tsconnect.d";
 
 /**
@@ -20,6 +22,11 @@ export interface IPNPackageConfig extends IPNConfig {
 }
 
 export async function createClient(opt: IPNPackageConfig) {
+  // Storage for files received with Taildrop
+  installMemoryFS();
+
+  Object.assign(globalThis, { tsconnectThrow });
+
   const go = new Go();
 
   const wasmInstance = await WebAssembly.instantiateStreaming(
@@ -38,12 +45,28 @@ export async function createClient(opt: IPNPackageConfig) {
   });
 }
 
+/**
+ * Go functions can not throw JS exceptions, so synchronous functions of the
+ * module return [result, error] and are wrapped with this. Defined here as the
+ * module would otherwise need eval, which is blocked by most CSPs.
+ */
+function tsconnectThrow<T>(f: (...args: unknown[]) => [T, Error | null]) {
+  return function (this: unknown, ...args: unknown[]): T {
+    const [result, error] = f.apply(this, args);
+    if (error) throw error;
+    return result;
+  };
+}
+
 export class IpnEventHandler extends EventTarget implements IPNCallbacks {
   Events = IpnEvents;
   NotifyBrowseToURLEvent = NotifyBrowseToURLEvent;
   NotifyNetMapEvent = NotifyNetMapEvent;
+  NotifyPeersChangedEvent = NotifyPeersChangedEvent;
   NotifyStateEvent = NotifyStateEvent;
   NotifyPanicRecoverEvent = NotifyPanicRecoverEvent;
+  NotifyIncomingFilesEvent = NotifyIncomingFilesEvent;
+  NotifyHealthEvent = NotifyHealthEvent;
 
   public constructor() {
     super();
@@ -57,6 +80,10 @@ export class IpnEventHandler extends EventTarget implements IPNCallbacks {
     this.dispatchEvent(new NotifyNetMapEvent(netMapStr));
   }
 
+  public notifyPeersChanged(delta: IPNPeersDelta) {
+    this.dispatchEvent(new NotifyPeersChangedEvent(delta));
+  }
+
   public notifyState(state: IPNState) {
     this.dispatchEvent(new NotifyStateEvent(state));
   }
@@ -65,6 +92,14 @@ export class IpnEventHandler extends EventTarget implements IPNCallbacks {
     this.dispatchEvent(new NotifyPanicRecoverEvent(err));
   }
 
+  public notifyIncomingFiles(files: IPNIncomingFiles) {
+    this.dispatchEvent(new NotifyIncomingFilesEvent(files));
+  }
+
+  public notifyHealth(warnings: IPNHealthWarning[]) {
+    this.dispatchEvent(new NotifyHealthEvent(warnings));
+  }
+
   public addEventListener<
     EventType extends keyof IpnEventMap,
     EventPayload extends Event = IpnEventMap[EventType],
@@ -80,15 +115,21 @@ export class IpnEventHandler extends EventTarget implements IPNCallbacks {
 enum IpnEvents {
   browseToURL = "BrowseToURL",
   netMap = "NetMap",
+  peersChanged = "PeersChanged",
   state = "State",
   panicRecover = "PanicRecover",
+  incomingFiles = "IncomingFiles",
+  health = "Health",
 }
 
 interface IpnEventMap {
   BrowseToURL: NotifyBrowseToURLEvent;
   NetMap: NotifyNetMapEvent;
+  PeersChanged: NotifyPeersChangedEvent;
   State: NotifyStateEvent;
   PanicRecover: NotifyPanicRecoverEvent;
+  IncomingFiles: NotifyIncomingFilesEvent;
+  Health: NotifyHealthEvent;
 }
 
 class NotifyBrowseToURLEvent extends Event {
@@ -109,6 +150,15 @@ class NotifyNetMapEvent extends Event {
   }
 }
 
+class NotifyPeersChangedEvent extends Event {
+  public readonly detail: { delta: IPNPeersDelta };
+
+  constructor(delta: IPNPeersDelta) {
+    super(IpnEvents.peersChanged);
+    this.detail = { delta };
+  }
+}
+
 class NotifyStateEvent extends Event {
   public readonly detail: { state: IPNState };
 
@@ -127,6 +177,24 @@ class NotifyPanicRecoverEvent extends Event {
   }
 }
 
+class NotifyIncomingFilesEvent extends Event {
+  public readonly detail: { files: IPNIncomingFiles };
+
+  constructor(files: IPNIncomingFiles) {
+    super(IpnEvents.incomingFiles);
+    this.detail = { files };
+  }
+}
+
+class NotifyHealthEvent extends Event {
+  public readonly detail: { warnings: IPNHealthWarning[] };
+
+  constructor(warnings: IPNHealthWarning[]) {
+    super(IpnEvents.health);
+    this.detail = { warnings };
+  }
+}
+
 export class IpnRawTcpChannel extends EventTarget implements RTCDataChannel {
   public static async connect(
     opt: Omit<Parameters<typeof window.ipn.tcp>[0], "readCallback">,
@@ -148,17 +216,21 @@ export class IpnRawTcpChannel extends EventTarget implements RTCDataChannel {
   public readonly id: number | null = null;
   public readonly maxPacketLifeTime: number | null = null;
   public readonly maxRetransmits: number | null = null;
-  public readonly bufferedAmount: number = 0;
+  public get bufferedAmount(): number {
+    return this.tcp.bufferedAmount();
+  }
   public readonly bufferedAmountLowThreshold: number = 0;
   public readonly negotiated: boolean = false;
   public readonly onbufferedamountlow: null = null;
   public readonly ordered: boolean = false;
   public readonly onopen: null = null;
-  public readonly onerror: null = null;
-  public readonly onclose: null = null;
+  /** Called when a write fails, the channel is closed afterwards */
+  public onerror: ((e: Event) => void) | null = null;
+  /** Called once the TCP session is closed, for any reason */
+  public onclose: ((e: Event) => void) | null = null;
   public readonly label: string = "IpnRawTcpChannel";
   public readonly binaryType: "arraybuffer" = "arraybuffer";
-  public readonly readyState: "open" = "open";
+  public readyState: RTCDataChannelState = "open";
   public readonly protocol: "wss" = "wss";
 
   public get remoteAddr(): string {
@@ -177,6 +249,12 @@ export class IpnRawTcpChannel extends EventTarget implements RTCDataChannel {
     super();
 
     this.tcp = tcp;
+    this.tcp.closed.then(() => {
+      this.readyState = "closed";
+      const ev = new Event("close");
+      this.dispatchEvent(ev);
+      this.onclose?.(ev);
+    });
   }
 
   public send(data: unknown): void {
@@ -185,11 +263,23 @@ export class IpnRawTcpChannel extends EventTarget implements RTCDataChannel {
       return;
     }
     // console.debug("IpnRawTcpChannel send", data, stringifyBuffer(data));
-    this.tcp.write(data);
+    this.tcp.write(data).catch((err: unknown) => {
+      // A lost write corrupts the stream, give up on the connection.
+      if (this.readyState !== "open") return;
+      console.error("IpnRawTcpChannel write failed:", err);
+      const ev = new ErrorEvent("error", { error: err, message: String(err) });
+      this.dispatchEvent(ev);
+      this.onerror?.(ev);
+      this.close();
+    });
   }
 
   public close(): void {
-    this.tcp.close();
+    if (this.readyState !== "open") return;
+    this.readyState = "closing";
+    this.tcp.close().catch((err: unknown) => {
+      console.error("IpnRawTcpChannel close failed:", err);
+    });
   }
 }
 
@@ -0,0 +1,383 @@
+/**
+ * @fileoverview In-memory replacement for the `fs` stub of wasm_exec.js.
+ *
+ * The browser has no disk, but Go's os package on js/wasm calls the Node.js
+ * style callback API on `globalThis.fs`. Taildrop stores received files in the
+ * Tailscale state directory, so this keeps those files in memory for as long
+ * as the tab is open. It has to be installed before `go.run()` because the Go
+ * runtime reads the fs constants on startup.
+ */
+
+type Callback<T = void> = (err: FSError | null, res?: T) => void;
+
+/** The parts of the wasm_exec.js fs stub that are still used */
+type StdioFS = {
+  constants: Record<string, number>;
+  writeSync(fd: number, buf: Uint8Array): number;
+  write(
+    fd: number,
+    buf: Uint8Array,
+    offset: number,
+    length: number,
+    position: number | null,
+    callback: Callback<number>,
+  ): void;
+};
+
+declare global {
+  // eslint-disable-next-line no-var
+  var fs: StdioFS | MemoryFS;
+}
+
+type FSError = Error & { code: string };
+
+type MemNode =
+  | { type: "dir"; mode: number; mtimeMs: number }
+  | {
+      type: "file";
+      mode: number;
+      mtimeMs: number;
+      data: Uint8Array;
+      size: number;
+    };
+
+type MemFD = { path: string; append: boolean; pos: number };
+
+type MemStat = ReturnType<typeof toStat>;
+
+const S_IFDIR = 0o040000;
+const S_IFREG = 0o100000;
+
+// Values from Linux, Go maps its own open flags onto these.
+const constants = {
+  O_WRONLY: 0o1,
+  O_RDWR: 0o2,
+  O_CREAT: 0o100,
+  O_EXCL: 0o200,
+  O_TRUNC: 0o1000,
+  O_APPEND: 0o2000,
+  O_DIRECTORY: 0o200000,
+};
+
+function fsError(code: string, path?: string): FSError {
+  const err = new Error(path ? `${code}: ${path}` : code) as FSError;
+  err.code = code;
+  return err;
+}
+
+function normalize(path: string): string {
+  const parts: string[] = [];
+  for (const part of path.split("/")) {
+    if (part === "" || part === ".") continue;
+    if (part === "..") parts.pop();
+    else parts.push(part);
+  }
+  return "/" + parts.join("/");
+}
+
+function dirname(path: string): string {
+  return normalize(path.substring(0, path.lastIndexOf("/")) || "/");
+}
+
+function toStat(node: MemNode) {
+  const size = node.type === "file" ? node.size : 0;
+  return {
+    dev: 0,
+    ino: 0,
+    mode: (node.type === "dir" ? S_IFDIR : S_IFREG) | (node.mode & 0o7777),
+    nlink: 1,
+    uid: 0,
+    gid: 0,
+    rdev: 0,
+    size,
+    blksize: 4096,
+    blocks: Math.ceil(size / 512),
+    atimeMs: node.mtimeMs,
+    mtimeMs: node.mtimeMs,
+    ctimeMs: node.mtimeMs,
+    isDirectory: () => node.type === "dir",
+  };
+}
+
+export class MemoryFS {
+  public readonly constants = constants;
+  /** Checked by the Go side before keeping state in the fs */
+  public readonly isMemoryFS = true;
+
+  private nodes = new Map<string, MemNode>([
+    ["/", { type: "dir", mode: 0o755, mtimeMs: Date.now() }],
+  ]);
+  private fds = new Map<number, MemFD>();
+  private nextFD = 100;
+
+  /**
+   * @param stdio fs used for the stdout and stderr of the Go runtime
+   */
+  public constructor(private readonly stdio: StdioFS) {}
+
+  public writeSync(fd: number, buf: Uint8Array): number {
+    return this.stdio.writeSync(fd, buf);
+  }
+
+  public write(
+    fd: number,
+    buf: Uint8Array,
+    offset: number,
+    length: number,
+    position: number | null,
+    callback: Callback<number>,
+  ) {
+    const f = this.fds.get(fd);
+    if (!f) {
+      this.stdio.write(fd, buf, offset, length, position, callback);
+      return;
+    }
+    const node = this.nodes.get(f.path);
+    if (node?.type !== "file") return callback(fsError("EBADF"));
+
+    let pos = position ?? f.pos;
+    if (f.append) pos = node.size;
+    this.resize(node, Math.max(node.size, pos + length));
+    node.data.set(buf.subarray(offset, offset + length), pos);
+    node.mtimeMs = Date.now();
+    if (position === null) f.pos = pos + length;
+    callback(null, length);
+  }
+
+  public read(
+    fd: number,
+    buf: Uint8Array,
+    offset: number,
+    length: number,
+    position: number | null,
+    callback: Callback<number>,
+  ) {
+    const f = this.fds.get(fd);
+    const node = f && this.nodes.get(f.path);
+    if (!f || node?.type !== "file") return callback(fsError("EBADF"));
+
+    const pos = position ?? f.pos;
+    const n = Math.max(0, Math.min(length, node.size - pos));
+    buf.set(node.data.subarray(pos, pos + n), offset);
+    if (position === null) f.pos = pos + n;
+    callback(null, n);
+  }
+
+  public open(
+    path: string,
+    flags: number,
+    mode: number,
+    callback: Callback<number>,
+  ) {
+    path = normalize(path);
+    let node = this.nodes.get(path);
+
+    if (node && flags & constants.O_CREAT && flags & constants.O_EXCL) {
+      return callback(fsError("EEXIST", path));
+    }
+    if (!node) {
+      if (!(flags & constants.O_CREAT)) {
+        return callback(fsError("ENOENT", path));
+      }
+      const parent = this.nodes.get(dirname(path));
+      if (!parent) return callback(fsError("ENOENT", path));
+      if (parent.type !== "dir") return callback(fsError("ENOTDIR", path));
+      node = {
+        type: "file",
+        mode,
+        mtimeMs: Date.now(),
+        data: new Uint8Array(0),
+        size: 0,
+      };
+      this.nodes.set(path, node);
+    }
+    const writable = flags & (constants.O_WRONLY | constants.O_RDWR);
+    if (node.type === "dir" && writable) {
+      return callback(fsError("EISDIR", path));
+    }
+    if (node.type === "file" && flags & constants.O_DIRECTORY) {
+      return callback(fsError("ENOTDIR", path));
+    }
+    if (node.type === "file" && flags & constants.O_TRUNC) {
+      this.resize(node, 0);
+    }
+
+    const fd = this.nextFD++;
+    this.fds.set(fd, { path, append: !!(flags & constants.O_APPEND), pos: 0 });
+    callback(null, fd);
+  }
+
+  public close(fd: number, callback: Callback) {
+    if (!this.fds.delete(fd)) return callback(fsError("EBADF"));
+    callback(null);
+  }
+
+  public fsync(fd: number, callback: Callback) {
+    callback(null);
+  }
+
+  public stat(path: string, callback: Callback<MemStat>) {
+    const node = this.nodes.get(normalize(path));
+    if (!node) return callback(fsError("ENOENT", path));
+    callback(null, toStat(node));
+  }
+
+  public lstat(path: string, callback: Callback<MemStat>) {
+    this.stat(path, callback);
+  }
+
+  public fstat(fd: number, callback: Callback<MemStat>) {
+    const f = this.fds.get(fd);
+    if (!f) return callback(fsError("EBADF"));
+    this.stat(f.path, callback);
+  }
+
+  public readdir(path: string, callback: Callback<string[]>) {
+    path = normalize(path);
+    const node = this.nodes.get(path);
+    if (!node) return callback(fsError("ENOENT", path));
+    if (node.type !== "dir") return callback(fsError("ENOTDIR", path));
+    callback(null, this.children(path));
+  }
+
+  public mkdir(path: string, perm: number, callback: Callback) {
+    path = normalize(path);
+    if (this.nodes.has(path)) return callback(fsError("EEXIST", path));
+    const parent = this.nodes.get(dirname(path));
+    if (!parent) return callback(fsError("ENOENT", path));
+    if (parent.type !== "dir") return callback(fsError("ENOTDIR", path));
+    this.nodes.set(path, { type: "dir", mode: perm, mtimeMs: Date.now() });
+    callback(null);
+  }
+
+  public unlink(path: string, callback: Callback) {
+    path = normalize(path);
+    const node = this.nodes.get(path);
+    if (!node) return callback(fsError("ENOENT", path));
+    if (node.type === "dir") return callback(fsError("EISDIR", path));
+    this.nodes.delete(path);
+    callback(null);
+  }
+
+  public rmdir(path: string, callback: Callback) {
+    path = normalize(path);
+    const node = this.nodes.get(path);
+    if (!node) return callback(fsError("ENOENT", path));
+    if (node.type !== "dir") return callback(fsError("ENOTDIR", path));
+    if (this.children(path).length) return callback(fsError("ENOTEMPTY", path));
+    this.nodes.delete(path);
+    callback(null);
+  }
+
+  public rename(from: string, to: string, callback: Callback) {
+    from = normalize(from);
+    to = normalize(to);
+    const node = this.nodes.get(from);
+    if (!node) return callback(fsError("ENOENT", from));
+    if (node.type === "dir") return callback(fsError("EINVAL", from));
+    if (!this.nodes.has(dirname(to))) return callback(fsError("ENOENT", to));
+    if (this.nodes.get(to)?.type === "dir") {
+      return callback(fsError("EISDIR", to));
+    }
+    this.nodes.delete(from);
+    this.nodes.set(to, node);
+    for (const f of this.fds.values()) {
+      if (f.path === from) f.path = to;
+    }
+    callback(null);
+  }
+
+  public truncate(path: string, length: number, callback: Callback) {
+    const node = this.nodes.get(normalize(path));
+    if (!node) return callback(fsError("ENOENT", path));
+    if (node.type !== "file") return callback(fsError("EISDIR", path));
+    this.resize(node, length);
+    callback(null);
+  }
+
+  public ftruncate(fd: number, length: number, callback: Callback) {
+    const f = this.fds.get(fd);
+    if (!f) return callback(fsError("EBADF"));
+    this.truncate(f.path, length, callback);
+  }
+
+  public utimes(
+    path: string,
+    atime: number,
+    mtime: number,
+    callback: Callback,
+  ) {
+    const node = this.nodes.get(normalize(path));
+    if (!node) return callback(fsError("ENOENT", path));
+    node.mtimeMs = mtime * 1000;
+    callback(null);
+  }
+
+  public chmod(path: string, mode: number, callback: Callback) {
+    const node = this.nodes.get(normalize(path));
+    if (!node) return callback(fsError("ENOENT", path));
+    node.mode = mode;
+    callback(null);
+  }
+
+  public fchmod(fd: number, mode: number, callback: Callback) {
+    const f = this.fds.get(fd);
+    if (!f) return callback(fsError("EBADF"));
+    this.chmod(f.path, mode, callback);
+  }
+
+  public chown(path: string, uid: number, gid: number, callback: Callback) {
+    callback(fsError("ENOSYS"));
+  }
+  public fchown(fd: number, uid: number, gid: number, callback: Callback) {
+    callback(fsError("ENOSYS"));
+  }
+  public lchown(path: string, uid: number, gid: number, callback: Callback) {
+    callback(fsError("ENOSYS"));
+  }
+  public link(path: string, link: string, callback: Callback) {
+    callback(fsError("ENOSYS"));
+  }
+  public symlink(path: string, link: string, callback: Callback) {
+    callback(fsError("ENOSYS"));
+  }
+  public readlink(path: string, callback: Callback) {
+    callback(fsError("EINVAL", path));
+  }
+
+  private children(dir: string): string[] {
+    const prefix = dir === "/" ? "/" : dir + "/";
+    const names: string[] = [];
+    for (const path of this.nodes.keys()) {
+      if (
+        path !== "/" &&
+        path.startsWith(prefix) &&
+        !path.includes("/", prefix.length)
+      ) {
+        names.push(path.substring(prefix.length));
+      }
+    }
+    return names;
+  }
+
+  private resize(node: MemNode & { type: "file" }, size: number) {
+    if (size > node.data.length) {
+      const data = new Uint8Array(Math.max(size, node.data.length * 2));
+      data.set(node.data.subarray(0, node.size));
+      node.data = data;
+    } else if (size < node.size) {
+      node.data.fill(0, size, node.size);
+    }
+    node.size = size;
+  }
+}
+
+/**
+ * Replaces the fs stub of wasm_exec.js with a MemoryFS. A real fs, e.g. in
+ * Node.js, is left alone.
+ */
+export function installMemoryFS() {
+  const fs = globalThis.fs;
+  if (fs instanceof MemoryFS || fs.constants.O_WRONLY !== -1) return;
+  globalThis.fs = new MemoryFS(fs);
+}
@@ -13,38 +13,60 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"syscall/js"
 	"time"
 
 	"golang.org/x/crypto/ssh"
-	"tailscale.com/client/local"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnserver"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/logpolicy"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netns"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tsconst"
 	"tailscale.com/tsd"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
 	"tailscale.com/types/views"
+	"tailscale.com/version"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/netstack"
 	"tailscale.com/words"
@@ -53,11 +75,13 @@ import (
 // ControlURL defines the URL to be used for connection to Control.
 var ControlURL = ipn.DefaultControlURL
 
+// varRoot is the Tailscale state directory, see LocalBackend.SetVarRoot.
+const varRoot = "/tailscale"
+
 func main() {
-	js.Global().Set("newIPN", js.FuncOf(func(this js.Value, args []js.Value) any {
-		if len(args) != 1 {
-			log.Fatal("Usage: newIPN(config)")
-			return nil
+	js.Global().Set("newIPN", jsFunc(func(args []js.Value) (any, error) {
+		if len(args) != 1 || args[0].Type() != js.TypeObject {
+			return nil, jsErrorf(errCodeInvalidArgument, "Usage: newIPN(config)")
 		}
 		return newIPN(args[0])
 	}))
@@ -66,7 +90,10 @@ func main() {
 	<-make(chan bool)
 }
 
-func newIPN(jsConfig js.Value) map[string]any {
+func newIPN(jsConfig js.Value) (map[string]any, error) {
+	if err := logs.configure(jsConfig); err != nil {
+		return nil, err
+	}
 	netns.SetEnabled(false)
 
 	var store ipn.StateStore
@@ -105,7 +132,17 @@ func newIPN(jsConfig js.Value) map[string]any {
 			advertiseTags = strings.Split(tags, ";")
 		}
 	}
-	log.Printf("AdvertiseTags: %v len: %v", advertiseTags, len(advertiseTags))
+	logs.debugf("AdvertiseTags: %v len: %v", advertiseTags, len(advertiseTags))
+
+	netMapThrottle := defaultNetMapThrottle
+	if jsThrottle := jsConfig.Get("netMapThrottleMs"); jsThrottle.Type() == js.TypeNumber {
+		netMapThrottle = time.Duration(jsThrottle.Float() * float64(time.Millisecond))
+	}
+
+	var preferredDERP int
+	if jsPreferredDERP := jsConfig.Get("preferredDERPRegion"); jsPreferredDERP.Type() == js.TypeNumber {
+		preferredDERP = jsPreferredDERP.Int()
+	}
 
 	lpc := getOrCreateLogPolicyConfig(store)
 	// c := logtail.Config{
@@ -121,8 +158,8 @@ func newIPN(jsConfig js.Value) map[string]any {
 
 	sys := new(tsd.System)
 	sys.Set(store)
-	dialer := &tsdial.Dialer{Logf: log.Printf}
-	eng, err := wgengine.NewUserspaceEngine(log.Printf, wgengine.Config{
+	dialer := &tsdial.Dialer{Logf: logs.logf("tsdial")}
+	eng, err := wgengine.NewUserspaceEngine(logs.logf("wgengine"), wgengine.Config{
 		Dialer:        dialer,
 		SetSubsystem:  sys.Set,
 		ControlKnobs:  sys.ControlKnobs(),
@@ -130,13 +167,13 @@ func newIPN(jsConfig js.Value) map[string]any {
 		Metrics:       sys.UserMetricsRegistry(),
 	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("wgengine.NewUserspaceEngine: %w", err)
 	}
 	sys.Set(eng)
 
-	ns, err := netstack.Create(log.Printf, sys.Tun.Get(), eng, sys.MagicSock.Get(), dialer, sys.DNSManager.Get(), sys.ProxyMapper())
+	ns, err := netstack.Create(logs.logf("netstack"), sys.Tun.Get(), eng, sys.MagicSock.Get(), dialer, sys.DNSManager.Get(), sys.ProxyMapper())
 	if err != nil {
-		log.Fatalf("netstack.Create: %v", err)
+		return nil, fmt.Errorf("netstack.Create: %w", err)
 	}
 	sys.Set(ns)
 	ns.ProcessLocalIPs = true
@@ -145,9 +182,6 @@ func newIPN(jsConfig js.Value) map[string]any {
 	dialer.UseNetstackForIP = func(ip netip.Addr) bool {
 		return true
 	}
-	dialer.NetstackDialTCP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
-		return ns.DialContextTCP(ctx, dst)
-	}
 	dialer.NetstackDialUDP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
 		return ns.DialContextUDP(ctx, dst)
 	}
@@ -155,108 +189,357 @@ func newIPN(jsConfig js.Value) map[string]any {
 	sys.Tun.Get().Start()
 
 	logid := lpc.PublicID
-	srv := ipnserver.New(log.Printf, logid, sys.NetMon.Get())
-	lb, err := ipnlocal.NewLocalBackend(log.Printf, logid, sys, controlclient.LoginDefault)
+	srv := ipnserver.New(logs.logf("ipnserver"), logid, sys.NetMon.Get())
+	lb, err := ipnlocal.NewLocalBackend(logs.logf("ipnlocal"), logid, sys, controlclient.LoginDefault)
 	if err != nil {
-		log.Fatalf("ipnlocal.NewLocalBackend: %v", err)
+		return nil, fmt.Errorf("ipnlocal.NewLocalBackend: %w", err)
 	}
 	if err := ns.Start(lb); err != nil {
-		log.Fatalf("failed to start netstack: %v", err)
+		return nil, fmt.Errorf("failed to start netstack: %w", err)
+	}
+	// Taildrop keeps received files below the var root, backed by the
+	// MemoryFS of memfs.ts. Without it, e.g. with the real fs of Node.js,
+	// there is no var root and Taildrop stays disabled.
+	if js.Global().Get("fs").Get("isMemoryFS").Truthy() {
+		lb.SetVarRoot(varRoot)
 	}
 	srv.SetLocalBackend(lb)
+	if preferredDERP != 0 {
+		sys.MagicSock.Get().DebugForcePreferDERP(preferredDERP)
+	}
 
 	jsIPN := &jsIPN{
-		dialer:        dialer,
-		srv:           srv,
-		lb:            lb,
-		controlURL:    controlURL,
-		authKey:       authKey,
-		hostname:      hostname,
-		routeAll:      routeAll,
-		advertiseTags: advertiseTags,
+		dialer:         dialer,
+		srv:            srv,
+		lb:             lb,
+		controlURL:     controlURL,
+		authKey:        authKey,
+		hostname:       hostname,
+		routeAll:       routeAll,
+		advertiseTags:  advertiseTags,
+		netMapThrottle: netMapThrottle,
+		preferredDERP:  preferredDERP,
+	}
+
+	// Everything is dialed through netstack, destinations outside of the
+	// tailnet are routed through the exit node.
+	dialer.NetstackDialTCP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+		if err := jsIPN.checkRoute(dst.Addr()); err != nil {
+			return nil, err
+		}
+		if err := jsIPN.checkACL(dst.Addr()); err != nil {
+			return nil, err
+		}
+		return ns.DialContextTCP(ctx, dst)
 	}
 
 	return map[string]any{
-		"run": js.FuncOf(func(this js.Value, args []js.Value) any {
+		"run": jsFunc(func(args []js.Value) (any, error) {
 			if len(args) != 1 || args[0].Type() != js.TypeObject {
-				log.Fatal(`Usage: run({ ... })`)
-				return nil
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: run({ ... })")
+			}
+			if !jsIPN.started.CompareAndSwap(false, true) {
+				return nil, jsErrorf(errCodeInvalidArgument, "run() was already called")
 			}
 			jsIPN.run(args[0])
-			return nil
+			return nil, nil
 		}),
 		"login": js.FuncOf(func(this js.Value, args []js.Value) any {
 			if len(args) != 0 {
-				log.Printf("Usage: login()")
-				return nil
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: login()"))
 			}
-			jsIPN.login()
-			return nil
+			return makePromise(jsIPN.login)
 		}),
 		"logout": js.FuncOf(func(this js.Value, args []js.Value) any {
 			if len(args) != 0 {
-				log.Printf("Usage: logout()")
-				return nil
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: logout()"))
 			}
-			jsIPN.logout()
-			return nil
+			return makePromise(jsIPN.logout)
 		}),
 		"newProfile": js.FuncOf(func(this js.Value, args []js.Value) any {
 			if len(args) != 0 {
-				log.Printf("Usage: newProfile()")
-				return nil
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: newProfile()"))
 			}
-			jsIPN.newProfile()
-			return nil
+			return makePromise(jsIPN.newProfile)
 		}),
 		"deleteProfile": js.FuncOf(func(this js.Value, args []js.Value) any {
-			if len(args) != 1 {
-				log.Printf("Usage: newProfile(id)")
-				return nil
+			if len(args) != 1 || args[0].Type() != js.TypeString {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: deleteProfile(id)"))
 			}
-			jsIPN.deleteProfile(ipn.ProfileID(args[0].String()))
-			return nil
+			id := ipn.ProfileID(args[0].String())
+			return makePromise(func() (any, error) {
+				return jsIPN.deleteProfile(id)
+			})
 		}),
 		"switchProfile": js.FuncOf(func(this js.Value, args []js.Value) any {
-			if len(args) != 1 {
-				log.Printf("Usage: newProfile(id)")
-				return nil
+			if len(args) != 1 || args[0].Type() != js.TypeString {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: switchProfile(id)"))
 			}
-			jsIPN.switchProfile(ipn.ProfileID(args[0].String()))
-			return nil
+			id := ipn.ProfileID(args[0].String())
+			return makePromise(func() (any, error) {
+				return jsIPN.switchProfile(id)
+			})
 		}),
-		"ssh": js.FuncOf(func(this js.Value, args []js.Value) any {
-			if len(args) != 3 {
-				log.Printf("Usage: ssh(hostname, userName, termConfig)")
-				return nil
+		"listProfiles": jsFunc(func(args []js.Value) (any, error) {
+			if len(args) != 0 {
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: listProfiles()")
+			}
+			return jsIPN.listProfiles(), nil
+		}),
+		"currentProfile": jsFunc(func(args []js.Value) (any, error) {
+			if len(args) != 0 {
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: currentProfile()")
+			}
+			return jsIPN.currentProfile(), nil
+		}),
+		"health": jsFunc(func(args []js.Value) (any, error) {
+			if len(args) != 0 {
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: health()")
+			}
+			return jsHealth(jsIPN.lb.HealthTracker().CurrentState()), nil
+		}),
+		"debugBundle": jsFunc(func(args []js.Value) (any, error) {
+			if len(args) > 1 || (len(args) == 1 && args[0].Type() != js.TypeObject) {
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: debugBundle({ includeSecrets })")
+			}
+			includeSecrets := len(args) == 1 && args[0].Get("includeSecrets").Truthy()
+			return jsIPN.debugBundle(includeSecrets)
+		}),
+		"getNetMap": jsFunc(func(args []js.Value) (any, error) {
+			if len(args) != 0 {
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: getNetMap()")
+			}
+			nm := jsIPN.lb.NetMap()
+			if nm == nil {
+				return nil, nil
+			}
+			b, err := json.Marshal(jsIPN.jsNetMap(nm))
+			if err != nil {
+				return nil, err
+			}
+			return string(b), nil
+		}),
+		"canConnect": jsFunc(func(args []js.Value) (any, error) {
+			if len(args) != 1 || args[0].Type() != js.TypeString {
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: canConnect(peer)")
+			}
+			return jsIPN.canConnect(args[0].String())
+		}),
+		"probeServices": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) < 1 || len(args) > 3 || args[0].Type() != js.TypeString {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: probeServices(peer, ports?, timeoutMs?)"))
+			}
+			ports := defaultProbePorts
+			if len(args) > 1 && args[1].Truthy() {
+				if !js.Global().Get("Array").Call("isArray", args[1]).Bool() {
+					return rejectedPromise(jsErrorf(errCodeInvalidArgument, "ports must be an array"))
+				}
+				ports = make([]int, args[1].Length())
+				for n := range ports {
+					port := args[1].Index(n)
+					if port.Type() != js.TypeNumber || port.Int() < 1 || port.Int() > 65535 {
+						return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Invalid port %v", port))
+					}
+					ports[n] = port.Int()
+				}
+			}
+			timeout := defaultProbeTimeout
+			if len(args) > 2 && !args[2].IsUndefined() && !args[2].IsNull() {
+				if args[2].Type() != js.TypeNumber || !(args[2].Float() > 0) {
+					return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Invalid timeoutMs %v", args[2]))
+				}
+				timeout = time.Duration(args[2].Float() * float64(time.Millisecond))
+			}
+			peer := args[0].String()
+			return makePromise(func() (any, error) {
+				if err := jsIPN.checkRunning(); err != nil {
+					return nil, err
+				}
+				return jsIPN.probeServices(peer, ports, timeout)
+			})
+		}),
+		"ping": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) < 1 || len(args) > 2 || args[0].Type() != js.TypeString || (len(args) == 2 && args[1].Type() != js.TypeObject) {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: ping(peer, { type, count, timeoutMs, untilDirect, onAttempt })"))
+			}
+			options := js.Global().Get("Object").New()
+			if len(args) == 2 {
+				options = args[1]
+			}
+			pingType := tailcfg.PingDisco
+			if jsType := options.Get("type"); !jsType.IsUndefined() {
+				pingType = tailcfg.PingType(jsType.String())
+				if !slices.Contains([]tailcfg.PingType{tailcfg.PingDisco, tailcfg.PingTSMP, tailcfg.PingICMP, tailcfg.PingPeerAPI}, pingType) {
+					return rejectedPromise(jsErrorf(errCodeInvalidArgument, "type must be disco, TSMP, ICMP or peerapi"))
+				}
+			}
+			count := defaultPingCount
+			if jsCount := options.Get("count"); jsCount.Type() == js.TypeNumber {
+				count = jsCount.Int()
+			}
+			if count < 1 {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "count must be at least 1"))
+			}
+			timeout := defaultPingTimeout
+			if jsTimeout := options.Get("timeoutMs"); jsTimeout.Type() == js.TypeNumber {
+				timeout = time.Duration(jsTimeout.Float() * float64(time.Millisecond))
+			}
+			untilDirect := true
+			if jsUntilDirect := options.Get("untilDirect"); jsUntilDirect.Type() == js.TypeBoolean {
+				untilDirect = jsUntilDirect.Bool()
+			}
+			peer, onAttempt := args[0].String(), options.Get("onAttempt")
+			return makePromise(func() (any, error) {
+				if err := jsIPN.checkRunning(); err != nil {
+					return nil, err
+				}
+				return jsIPN.ping(peer, pingType, count, timeout, untilDirect, onAttempt)
+			})
+		}),
+		"derpReport": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) != 0 {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: derpReport()"))
+			}
+			return makePromise(jsIPN.derpReport)
+		}),
+		"getPrefs": jsFunc(func(args []js.Value) (any, error) {
+			if len(args) != 0 {
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: getPrefs()")
+			}
+			return jsPrefs(jsIPN.lb.Prefs()), nil
+		}),
+		"sendFile": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) < 3 || len(args) > 4 || args[0].Type() != js.TypeString || args[1].Type() != js.TypeString || args[2].Type() != js.TypeObject {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: sendFile(peerID, name, data, { ... })"))
+			}
+			options := js.Global().Get("Object").New()
+			if len(args) == 4 && args[3].Type() == js.TypeObject {
+				options = args[3]
+			}
+			return jsIPN.sendFile(args[0].String(), args[1].String(), args[2], options)
+		}),
+		"waitingFiles": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) != 0 {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: waitingFiles()"))
+			}
+			return makePromise(jsIPN.waitingFiles)
+		}),
+		"openFile": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) != 1 || args[0].Type() != js.TypeString {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: openFile(name)"))
+			}
+			name := args[0].String()
+			return makePromise(func() (any, error) {
+				return jsIPN.openFile(name)
+			})
+		}),
+		"deleteFile": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) != 1 || args[0].Type() != js.TypeString {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: deleteFile(name)"))
+			}
+			name := args[0].String()
+			return makePromise(func() (any, error) {
+				if err := jsIPN.lb.DeleteFile(name); err != nil {
+					return nil, err
+				}
+				// The backend does not notify about deleted files.
+				jsIPN.notifyIncomingFiles(nil)
+				return nil, nil
+			})
+		}),
+		"tkaStatus": jsFunc(func(args []js.Value) (any, error) {
+			if len(args) != 0 {
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: tkaStatus()")
+			}
+			return jsIPN.tkaStatus(), nil
+		}),
+		"tkaSign": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) < 1 || len(args) > 2 || args[0].Type() != js.TypeString || (len(args) == 2 && args[1].Type() != js.TypeString) {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: tkaSign(nodeKey, rotationKey?)"))
+			}
+			nodeKey, rotationKey := args[0].String(), ""
+			if len(args) == 2 {
+				rotationKey = args[1].String()
+			}
+			return makePromise(func() (any, error) {
+				return nil, jsIPN.tkaSign(nodeKey, rotationKey)
+			})
+		}),
+		"suggestExitNode": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) != 0 {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: suggestExitNode()"))
+			}
+			return makePromise(jsIPN.suggestExitNode)
+		}),
+		"editPrefs": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) != 1 || args[0].Type() != js.TypeObject {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: editPrefs({ ... })"))
+			}
+			mp, err := jsIPN.maskedPrefs(args[0])
+			if err != nil {
+				return rejectedPromise(err)
+			}
+			return makePromise(func() (any, error) {
+				// Validate first, so that only invalid prefs fail with
+				// EINVAL and other backend errors keep their code.
+				p := jsIPN.lb.Prefs().AsStruct()
+				p.ApplyEdits(mp)
+				if err := jsIPN.lb.CheckPrefs(p); err != nil {
+					return nil, jsErrorf(errCodeInvalidArgument, "%v", err)
+				}
+				prefs, err := jsIPN.lb.EditPrefs(mp)
+				if err != nil {
+					return nil, err
+				}
+				return jsPrefs(prefs), nil
+			})
+		}),
+		"ssh": jsFunc(func(args []js.Value) (any, error) {
+			if len(args) != 3 || args[0].Type() != js.TypeString || args[1].Type() != js.TypeString || args[2].Type() != js.TypeObject {
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: ssh(hostname, userName, termConfig)")
+			}
+			if err := jsIPN.checkRunning(); err != nil {
+				return nil, err
 			}
 			return jsIPN.ssh(
 				args[0].String(),
 				args[1].String(),
-				args[2])
+				args[2]), nil
 		}),
 		"fetch": js.FuncOf(func(this js.Value, args []js.Value) any {
 			if len(args) != 1 || args[0].Type() != js.TypeObject {
-				log.Printf("Usage: fetch({ ... })")
-				return nil
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: fetch({ ... })"))
 			}
 			return jsIPN.fetch(args[0])
 		}),
 		"tcp": js.FuncOf(func(this js.Value, args []js.Value) any {
 			if len(args) != 1 || args[0].Type() != js.TypeObject {
-				log.Fatal(`Usage: tcp({ ... })`)
-				return nil
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: tcp({ ... })"))
 			}
 			return jsIPN.tcp(args[0])
 		}),
 		"resolve": js.FuncOf(func(this js.Value, args []js.Value) any {
+			if len(args) < 1 || len(args) > 2 || args[0].Type() != js.TypeString || (len(args) == 2 && args[1].Type() != js.TypeString) {
+				return rejectedPromise(jsErrorf(errCodeInvalidArgument, "Usage: resolve(name, type?)"))
+			}
+			name, recordType := args[0].String(), "A"
+			if len(args) == 2 {
+				recordType = args[1].String()
+			}
+			return makePromise(func() (any, error) {
+				if err := jsIPN.checkRunning(); err != nil {
+					return nil, err
+				}
+				return jsIPN.resolve(name, recordType)
+			})
+		}),
+		"resolveConnections": jsFunc(func(args []js.Value) (any, error) {
 			if len(args) != 1 || args[0].Type() != js.TypeString {
-				log.Fatal(`Usage: resolve(hostname)`)
-				return nil
+				return nil, jsErrorf(errCodeInvalidArgument, "Usage: resolveConnections(connectionsJSON)")
 			}
-			return jsIPN.resolve(args[0])
+			return jsIPN.resolveConnections(args[0].String())
 		}),
-	}
+	}, nil
 }
 
 type jsIPN struct {
@@ -268,6 +551,29 @@ type jsIPN struct {
 	hostname      string
 	routeAll      bool
 	advertiseTags []string
+
+	netMapThrottle time.Duration
+	probes         probeCache
+	peerPaths      peerPathCache
+	// preferredDERP is the DERP region pinned as home, 0 if not pinned.
+	preferredDERP int
+	// lastDERPReport is the netcheck report of the last derpReport() call.
+	lastDERPReport atomic.Pointer[netcheck.Report]
+
+	// started is set by the first run() call.
+	started atomic.Bool
+	// callbacks are the callbacks passed to run().
+	callbacks js.Value
+
+	// sessions maps the *sessionStats of open TCP and SSH sessions to their
+	// activeSession.
+	sessions sync.Map
+}
+
+type activeSession struct {
+	kind   string
+	target string
+	stats  func() map[string]any
 }
 
 var jsIPNState = map[ipn.State]string{
@@ -288,85 +594,60 @@ var jsMachineStatus = map[tailcfg.MachineStatus]string{
 }
 
 func (i *jsIPN) run(jsCallbacks js.Value) {
+	i.callbacks = jsCallbacks
 	notifyState := func(state ipn.State) {
 		jsCallbacks.Call("notifyState", jsIPNState[state])
 	}
 	notifyState(ipn.NoState)
 
+	recoverPanic := func() {
+		if r := recover(); r != nil {
+			fmt.Println("Panic recovered:", r)
+			jsCallbacks.Call("notifyPanicRecover", fmt.Sprint(r))
+		}
+	}
+	netMaps := &netMapNotifier{
+		jsIPN:       i,
+		jsCallbacks: jsCallbacks,
+		throttle:    i.netMapThrottle,
+		deltas:      jsCallbacks.Get("notifyPeersChanged").Type() == js.TypeFunction,
+		recover:     recoverPanic,
+	}
+
+	filesWaiting := false
 	i.lb.SetNotifyCallback(func(n ipn.Notify) {
 		// Panics in the notify callback are likely due to be due to bugs in
 		// this bridging module (as opposed to actual bugs in Tailscale) and
 		// thus may be recoverable. Let the UI know, and allow the user to
 		// choose if they want to reload the page.
-		defer func() {
-			if r := recover(); r != nil {
-				fmt.Println("Panic recovered:", r)
-				jsCallbacks.Call("notifyPanicRecover", fmt.Sprint(r))
-			}
-		}()
-		log.Printf("NOTIFY: %+v", n)
+		defer recoverPanic()
+		if logs.enabled(logLevelTrace) {
+			logs.tracef("NOTIFY: %+v", n)
+		}
 		if n.State != nil {
 			notifyState(*n.State)
 		}
+		// FilesWaiting is set on every notification while any file is
+		// waiting, so only report when it changes.
+		if n.IncomingFiles != nil || (n.FilesWaiting != nil) != filesWaiting {
+			filesWaiting = n.FilesWaiting != nil
+			i.notifyIncomingFiles(n.IncomingFiles)
+		}
 		if nm := n.NetMap; nm != nil {
-			jsNetMap := jsNetMap{
-				Self: jsNetMapSelfNode{
-					jsNetMapNode: jsNetMapNode{
-						Name:       nm.Name,
-						Addresses:  mapSliceView(nm.GetAddresses(), func(a netip.Prefix) string { return a.Addr().String() }),
-						NodeKey:    nm.NodeKey.String(),
-						MachineKey: nm.MachineKey.String(),
-						CreatedAt:  nm.SelfNode.Created().String(),
-						IPNVersion: nm.SelfNode.Hostinfo().IPNVersion(),
-					},
-					Tags:          nm.SelfNode.Tags(),
-					MachineStatus: jsMachineStatus[nm.GetMachineStatus()],
-				},
-				Users: nm.UserProfiles,
-				Peers: mapSlice(nm.Peers, func(p tailcfg.NodeView) jsNetMapPeerNode {
-					name := p.Name()
-					if name == "" {
-						// In practice this should only happen for Hello.
-						name = p.Hostinfo().Hostname()
-					}
-					addrs := make([]string, p.Addresses().Len())
-					for i, ap := range p.Addresses().All() {
-						addrs[i] = ap.Addr().String()
-					}
-					return jsNetMapPeerNode{
-						jsNetMapNode: jsNetMapNode{
-							Name:       name,
-							Addresses:  addrs,
-							MachineKey: p.Machine().String(),
-							NodeKey:    p.Key().String(),
-							CreatedAt:  p.Created().String(),
-							IPNVersion: p.Hostinfo().IPNVersion(),
-						},
-						LastSeen:            p.LastSeen().String(),
-						OS:                  p.Hostinfo().OS(),
-						OSVersion:           p.Hostinfo().OSVersion(),
-						User:                p.User().String(),
-						Tags:                p.Tags(),
-						Routes:              p.Hostinfo().RoutableIPs(),
-						Online:              *p.Online().Clone(),
-						Expired:             p.Expired(),
-						TailscaleSSHEnabled: p.Hostinfo().TailscaleSSHEnabled(),
-						ID:                  strconv.FormatInt(int64(p.ID()), 10),
-						CapMap:              p.CapMap().AsMap(),
-					}
-				}),
-				LockedOut: nm.TKAEnabled && nm.SelfNode.KeySignature().Len() == 0,
-				Domain:    nm.MagicDNSSuffix(),
-			}
-			if jsonNetMap, err := json.Marshal(jsNetMap); err == nil {
-				jsCallbacks.Call("notifyNetMap", string(jsonNetMap))
-			} else {
-				log.Printf("Could not generate JSON netmap: %v", err)
-			}
+			i.probes.clear()
+			netMaps.update(nm)
+		} else if n.Engine != nil {
+			netMaps.refresh()
 		}
 		if n.BrowseToURL != nil {
 			jsCallbacks.Call("notifyBrowseToURL", *n.BrowseToURL)
 		}
+		if n.Prefs != nil && jsCallbacks.Get("notifyPrefs").Type() == js.TypeFunction {
+			jsCallbacks.Call("notifyPrefs", jsPrefs(*n.Prefs))
+		}
+		if n.Health != nil && jsCallbacks.Get("notifyHealth").Type() == js.TypeFunction {
+			jsCallbacks.Call("notifyHealth", jsHealth(n.Health))
+		}
 	})
 
 	go func() {
@@ -382,501 +663,3053 @@ func (i *jsIPN) run(jsCallbacks js.Value) {
 			AuthKey: i.authKey,
 		})
 		if err != nil {
-			log.Printf("Start error: %v", err)
+			logs.errorf("Start error: %v", err)
 		}
 	}()
 
 	go func() {
 		ln, err := safesocket.Listen("")
 		if err != nil {
-			log.Fatalf("safesocket.Listen: %v", err)
+			logs.errorf("safesocket.Listen: %v", err)
+			return
 		}
 
 		err = i.srv.Run(context.Background(), ln)
-		log.Fatalf("ipnserver.Run exited: %v", err)
+		logs.errorf("ipnserver.Run exited: %v", err)
 	}()
 }
 
-func (i *jsIPN) login() {
-	go i.lb.StartLoginInteractive(context.Background())
-}
+// defaultStateTimeout bounds how long login, logout and the profile
+// operations wait for the backend to reach the resulting state.
+const defaultStateTimeout = 30 * time.Second
 
-func (i *jsIPN) logout() {
-	if i.lb.State() == ipn.NoState {
-		log.Printf("Backend not running")
+// login starts an interactive login. It resolves once the backend is Running
+// or the control server sent the URL the user has to visit.
+func (i *jsIPN) login() (any, error) {
+	if !i.started.Load() {
+		return nil, jsErrorf(errCodeNotRunning, "run() was not called")
+	}
+	if i.lb.State() == ipn.Running {
+		return i.stateResult(ipn.Running, ""), nil
 	}
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		i.lb.Logout(ctx)
-	}()
-}
-
-func (i *jsIPN) newProfile() {
-	go i.lb.NewProfile()
-}
-
-func (i *jsIPN) deleteProfile(id ipn.ProfileID) {
-	go i.lb.DeleteProfile(id)
-}
 
-func (i *jsIPN) switchProfile(id ipn.ProfileID) {
-	go i.lb.SwitchProfile(id)
-}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStateTimeout)
+	defer cancel()
+	if err := i.lb.StartLoginInteractive(ctx); err != nil {
+		return nil, err
+	}
 
-func (i *jsIPN) tcp(config js.Value) any {
-	return makePromise(func() (any, error) {
-		jsTCPSession, err := i.newJSTCPSession(config)
-		if err != nil {
-			return nil, err
+	var browseToURL string
+	state, err := i.waitForState(ctx, func(n *ipn.Notify, state ipn.State) bool {
+		if n.BrowseToURL != nil {
+			browseToURL = *n.BrowseToURL
+			return true
 		}
-
-		jsObjectWrapper := jsTCPSession.jsWrapper()
-		return jsObjectWrapper, nil
+		return state == ipn.Running
 	})
+	if err != nil {
+		return nil, err
+	}
+	return i.stateResult(state, browseToURL), nil
 }
 
-const defaultTCPConnectTimeoutSeconds = 5 * time.Second
-const defaultTCPWriteBufferSizeBytes = 1 << 20
-const defaultTCPReadBufferSizeBytes = 1 << 20
+func (i *jsIPN) logout() (any, error) {
+	if i.lb.State() == ipn.NoState {
+		return nil, jsErrorf(errCodeNotRunning, "Backend not running")
+	}
 
-type jsTCPSessionBuilder struct {
-	jsIPN           *jsIPN
-	addr            string
-	readCallback    func(js.Value)
-	writeBufferSize int
-	readBufferSize  int
-	connectTimeout  time.Duration
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStateTimeout)
+	defer cancel()
+	if err := i.lb.Logout(ctx); err != nil {
+		return nil, err
+	}
+	return i.waitForSettledState(ctx)
 }
 
-func (i *jsIPN) newJSTCPSession(config js.Value) (*jsTCPSession, error) {
-	builder := jsTCPSessionBuilder{
-		jsIPN:           i,
-		writeBufferSize: defaultTCPWriteBufferSizeBytes,
-		readBufferSize:  defaultTCPReadBufferSizeBytes,
-		connectTimeout:  defaultTCPConnectTimeoutSeconds,
+// checkRunning fails with ENOTRUNNING unless the backend is connected to the
+// tailnet.
+func (i *jsIPN) checkRunning() error {
+	if state := i.lb.State(); state != ipn.Running {
+		return jsErrorf(errCodeNotRunning, "Backend is %s, not Running", jsIPNState[state])
 	}
+	return nil
+}
 
-	if err := builder.setAddr(config); err != nil {
-		return nil, err
+// newProfile creates and switches to a new profile, it resolves once the
+// backend restarted with it.
+func (i *jsIPN) newProfile() (any, error) {
+	if !i.started.Load() {
+		return nil, jsErrorf(errCodeNotRunning, "run() was not called")
 	}
-	if err := builder.setReadCallback(config); err != nil {
+	if err := i.lb.NewProfile(); err != nil {
 		return nil, err
 	}
-	builder.setBufferSizes(config)
-	builder.setConnectTimeout(config)
 
-	return builder.connect()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStateTimeout)
+	defer cancel()
+	return i.waitForSettledState(ctx)
 }
 
-func (b *jsTCPSessionBuilder) setAddr(config js.Value) error {
-	jsHostname := config.Get("hostname")
-	if jsHostname.Type() != js.TypeString {
-		return errors.New("Hostname must be a string")
+// deleteProfile deletes a profile. Deleting the current profile restarts the
+// backend, it resolves once that is done.
+func (i *jsIPN) deleteProfile(id ipn.ProfileID) (any, error) {
+	if !i.started.Load() {
+		return nil, jsErrorf(errCodeNotRunning, "run() was not called")
 	}
-
-	jsPort := config.Get("port")
-	if jsPort.Type() != js.TypeNumber {
-		return errors.New("Port must be a number")
+	if !i.hasProfile(id) {
+		return nil, jsErrorf(errCodeInvalidArgument, "Unknown profile %q", id)
+	}
+	if err := i.lb.DeleteProfile(id); err != nil {
+		return nil, err
 	}
-	port := strconv.Itoa(jsPort.Int())
-	b.addr = net.JoinHostPort(jsHostname.String(), port)
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStateTimeout)
+	defer cancel()
+	return i.waitForSettledState(ctx)
 }
 
-func (b *jsTCPSessionBuilder) setReadCallback(config js.Value) error {
-	jsReadCallback := config.Get("readCallback")
-	if jsReadCallback.Type() != js.TypeFunction {
-		return errors.New("Invalid readCallback received")
+// switchProfile switches to another profile, it resolves once the backend
+// restarted with it.
+func (i *jsIPN) switchProfile(id ipn.ProfileID) (any, error) {
+	if !i.started.Load() {
+		return nil, jsErrorf(errCodeNotRunning, "run() was not called")
 	}
-	b.readCallback = func(subarray js.Value) {
-		jsReadCallback.Invoke(subarray)
+	if !i.hasProfile(id) {
+		return nil, jsErrorf(errCodeInvalidArgument, "Unknown profile %q", id)
+	}
+	if err := i.lb.SwitchProfile(id); err != nil {
+		return nil, err
 	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStateTimeout)
+	defer cancel()
+	return i.waitForSettledState(ctx)
 }
 
-func (b *jsTCPSessionBuilder) setBufferSizes(config js.Value) {
-	if jsWriteBufferSize := config.Get("writeBufferSizeInBytes"); jsWriteBufferSize.Type() == js.TypeNumber {
-		b.writeBufferSize = jsWriteBufferSize.Int()
-	}
-
-	if jsReadBufferSize := config.Get("ReadBufferSizeInBytes"); jsReadBufferSize.Type() == js.TypeNumber {
-		b.readBufferSize = jsReadBufferSize.Int()
-	}
+func (i *jsIPN) hasProfile(id ipn.ProfileID) bool {
+	return slices.ContainsFunc(i.lb.ListProfiles(), func(p ipn.LoginProfileView) bool {
+		return p.ID() == id
+	})
 }
 
-func (b *jsTCPSessionBuilder) setConnectTimeout(config js.Value) {
-	if jsConnectTimeout := config.Get("connectTimeout"); jsConnectTimeout.Type() == js.TypeNumber {
-		b.connectTimeout = time.Duration(jsConnectTimeout.Float() * float64(time.Second))
+// waitForState blocks until done returns true for a notification. The
+// backend state is passed along, it is the last known one if the
+// notification has none.
+func (i *jsIPN) waitForState(ctx context.Context, done func(n *ipn.Notify, state ipn.State) bool) (ipn.State, error) {
+	state := i.lb.State()
+	finished := false
+	i.lb.WatchNotifications(ctx, ipn.NotifyInitialState, nil, func(n *ipn.Notify) bool {
+		if n.State != nil {
+			state = *n.State
+		}
+		finished = done(n, state)
+		return !finished
+	})
+	if !finished {
+		return state, jsErrorf(errCodeTimedOut, "Timed out waiting for the backend, it is %s", jsIPNState[state])
 	}
+	return state, nil
 }
 
-func (b *jsTCPSessionBuilder) connect() (*jsTCPSession, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), b.connectTimeout)
-	defer cancel()
-
-	conn, err := b.jsIPN.dialer.UserDial(ctx, "tcp", b.addr)
+// waitForSettledState waits until the backend left the transitional NoState
+// and Starting states.
+func (i *jsIPN) waitForSettledState(ctx context.Context) (any, error) {
+	state, err := i.waitForState(ctx, func(_ *ipn.Notify, state ipn.State) bool {
+		return state != ipn.NoState && state != ipn.Starting
+	})
 	if err != nil {
 		return nil, err
 	}
+	return i.stateResult(state, ""), nil
+}
 
-	s := &jsTCPSession{
-		jsIPN:        b.jsIPN,
-		conn:         conn,
-		writeBuffer:  make([]byte, b.writeBufferSize),
-		readBuffer:   make([]byte, b.readBufferSize),
-		readCallback: b.readCallback,
+func (i *jsIPN) stateResult(state ipn.State, browseToURL string) map[string]any {
+	res := map[string]any{
+		"state":   jsIPNState[state],
+		"profile": i.currentProfile(),
 	}
+	if browseToURL != "" {
+		res["browseToURL"] = browseToURL
+	}
+	return res
+}
 
-	go s.readLoop()
-
-	return s, nil
+func (i *jsIPN) listProfiles() []any {
+	current := i.lb.CurrentProfile()
+	return mapSlice(i.lb.ListProfiles(), func(p ipn.LoginProfileView) any {
+		return i.jsProfile(p, p.ID() == current.ID())
+	})
 }
 
-type jsTCPSession struct {
-	jsIPN        *jsIPN
-	conn         net.Conn
-	writeBuffer  []byte
-	readBuffer   []byte
-	readCallback func(js.Value)
+// currentProfile returns null if the current profile was not persisted yet.
+func (i *jsIPN) currentProfile() any {
+	p := i.lb.CurrentProfile()
+	if !p.Valid() || p.ID() == "" {
+		return nil
+	}
+	return i.jsProfile(p, true)
 }
 
-func (s *jsTCPSession) readLoop() {
-	defer s.conn.Close()
-	dst := js.Global().Get("Uint8Array").New(len(s.readBuffer))
+// healthSeverityOrder sorts health warnings, most severe first.
+var healthSeverityOrder = map[health.Severity]int{
+	health.SeverityHigh:   0,
+	health.SeverityMedium: 1,
+	health.SeverityLow:    2,
+}
 
-	// we always reuse the same dst but make use of subarrays
-	subarray := dst.Call("subarray", 0, len(s.readBuffer))
-	subarrayLength := len(s.readBuffer)
-	for {
-		n, err := s.conn.Read(s.readBuffer[:])
-		if err != nil {
-			if err == io.EOF {
-				return
-			}
-			log.Printf("read error: %v", err)
-			return
+// jsHealth returns the unhealthy warnables, most severe first. Warnables that
+// became healthy are absent.
+func jsHealth(st *health.State) []any {
+	warnings := slices.Collect(maps.Values(st.Warnings))
+	slices.SortFunc(warnings, func(a, b health.UnhealthyState) int {
+		if c := cmp.Compare(healthSeverityOrder[a.Severity], healthSeverityOrder[b.Severity]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.WarnableCode, b.WarnableCode)
+	})
+	return mapSlice(warnings, func(w health.UnhealthyState) any {
+		var brokenSince any
+		if w.BrokenSince != nil {
+			brokenSince = w.BrokenSince.UnixMilli()
 		}
-		// if subarray is not already the correct length,
-		// create a new one from dst with correct len
-		if subarrayLength != n {
-			subarrayLength = n
-			subarray = dst.Call("subarray", 0, n)
+		return map[string]any{
+			"code":                string(w.WarnableCode),
+			"severity":            string(w.Severity),
+			"title":               w.Title,
+			"text":                w.Text,
+			"brokenSince":         brokenSince,
+			"impactsConnectivity": w.ImpactsConnectivity,
+			"dependsOn": mapSlice(w.DependsOn, func(c health.WarnableCode) any {
+				return string(c)
+			}),
 		}
+	})
+}
 
-		js.CopyBytesToJS(subarray, s.readBuffer[:n])
-
-		s.readCallback(subarray)
+// jsPrefs returns the prefs that can be changed with editPrefs.
+func jsPrefs(p ipn.PrefsView) map[string]any {
+	prefs := map[string]any{
+		"controlURL":             p.ControlURL(),
+		"wantRunning":            p.WantRunning(),
+		"exitNodeID":             string(p.ExitNodeID()),
+		"exitNodeIP":             "",
+		"exitNodeAllowLANAccess": p.ExitNodeAllowLANAccess(),
+		"routeAll":               p.RouteAll(),
+		"shieldsUp":              p.ShieldsUp(),
+		"hostname":               p.Hostname(),
+		"advertiseTags":          mapSliceView(p.AdvertiseTags(), func(t string) any { return t }),
+		"corpDNS":                p.CorpDNS(),
 	}
+	if p.ExitNodeIP().IsValid() {
+		prefs["exitNodeIP"] = p.ExitNodeIP().String()
+	}
+	return prefs
 }
 
-func (s *jsTCPSession) jsWrapper() any {
-	return map[string]any{
-		"remoteAddr": s.conn.RemoteAddr().String(),
-		/**
-		 * Closes the TCP connetion
-		 *
-		 * @returns Promise<void>
-		 */
-		"close": js.FuncOf(func(this js.Value, args []js.Value) any {
-			return makePromise(func() (any, error) {
-				err := s.conn.Close()
+// editablePrefs maps the keys accepted by editPrefs to their JS type.
+var editablePrefs = map[string]js.Type{
+	"exitNode":               js.TypeString,
+	"exitNodeAllowLANAccess": js.TypeBoolean,
+	"routeAll":               js.TypeBoolean,
+	"shieldsUp":              js.TypeBoolean,
+	"corpDNS":                js.TypeBoolean,
+	"hostname":               js.TypeString,
+	"advertiseTags":          js.TypeObject,
+}
+
+// maskedPrefs converts an editPrefs patch to MaskedPrefs. Only the keys
+// present in the patch are changed.
+func (i *jsIPN) maskedPrefs(patch js.Value) (*ipn.MaskedPrefs, error) {
+	mp := &ipn.MaskedPrefs{}
+	keys := js.Global().Get("Object").Call("keys", patch)
+	for k := 0; k < keys.Length(); k++ {
+		key := keys.Index(k).String()
+		value := patch.Get(key)
+
+		wantType, ok := editablePrefs[key]
+		if !ok {
+			return nil, jsErrorf(errCodeInvalidArgument, "Unknown pref %q", key)
+		}
+		// null clears the exit node.
+		if key == "exitNode" && value.Type() == js.TypeNull {
+			wantType = js.TypeNull
+		}
+		if value.Type() != wantType {
+			return nil, jsErrorf(errCodeInvalidArgument, "%s must be a %s", key, wantType)
+		}
+
+		switch key {
+		case "exitNode":
+			if err := i.setExitNode(mp, value); err != nil {
 				return nil, err
-			})
-		}),
-		/**
-		 * Write to the TCP connection
-		 *
-		 * @param src ArrayBuffer
-		 * @returns Promise<number> of bytes written
-		 */
-		"write": js.FuncOf(func(this js.Value, args []js.Value) any {
-			return makePromise(func() (any, error) {
-				if len(args) != 1 {
-					return nil, errors.New("Did not receive src argument")
+			}
+		case "exitNodeAllowLANAccess":
+			mp.ExitNodeAllowLANAccess = value.Bool()
+			mp.ExitNodeAllowLANAccessSet = true
+		case "routeAll":
+			mp.RouteAll = value.Bool()
+			mp.RouteAllSet = true
+		case "shieldsUp":
+			mp.ShieldsUp = value.Bool()
+			mp.ShieldsUpSet = true
+		case "corpDNS":
+			mp.CorpDNS = value.Bool()
+			mp.CorpDNSSet = true
+		case "hostname":
+			mp.Hostname = value.String()
+			mp.HostnameSet = true
+		case "advertiseTags":
+			if !value.InstanceOf(js.Global().Get("Array")) {
+				return nil, jsErrorf(errCodeInvalidArgument, "advertiseTags must be an array")
+			}
+			tags := make([]string, value.Length())
+			for t := range tags {
+				tag := value.Index(t)
+				if tag.Type() != js.TypeString {
+					return nil, jsErrorf(errCodeInvalidArgument, "advertiseTags must only contain strings")
 				}
-				src := args[0]
-				if byteLength := src.Get("byteLength"); byteLength.Type() == js.TypeNumber {
-					return s.write(src, byteLength.Int())
+				if err := tailcfg.CheckTag(tag.String()); err != nil {
+					return nil, jsErrorf(errCodeInvalidArgument, "Invalid tag %q: %v", tag.String(), err)
 				}
-				return nil, errors.New("Invalid type has no byteLength")
-			})
-		}),
+				tags[t] = tag.String()
+			}
+			mp.AdvertiseTags = tags
+			mp.AdvertiseTagsSet = true
+		}
 	}
+	return mp, nil
 }
 
-func (s *jsTCPSession) write(src js.Value, length int) (int, error) {
-	if len(s.writeBuffer) < length {
-		s.writeBuffer = make([]byte, length)
+// setExitNode selects the exit node by IP, stable node ID or the node ID used
+// in the netmap. "auto" selects the suggested exit node, an empty string or
+// null clears it.
+func (i *jsIPN) setExitNode(mp *ipn.MaskedPrefs, value js.Value) error {
+	mp.ExitNodeIDSet = true
+	mp.ExitNodeIPSet = true
+	if value.Type() == js.TypeNull || value.String() == "" {
+		return nil
+	}
+
+	exitNode := value.String()
+	if exitNode == "auto" {
+		suggestion, err := i.lb.SuggestExitNode()
+		if err != nil {
+			return jsErrorf(errCodeHostUnreachable, "No exit node to suggest: %v", err)
+		}
+		mp.ExitNodeID = suggestion.ID
+		return nil
+	}
+	if ip, err := netip.ParseAddr(exitNode); err == nil {
+		mp.ExitNodeIP = ip
+		return nil
+	}
+
+	if nm := i.lb.NetMap(); nm != nil {
+		for _, p := range nm.Peers {
+			if string(p.StableID()) == exitNode || strconv.FormatInt(int64(p.ID()), 10) == exitNode {
+				mp.ExitNodeID = p.StableID()
+				return nil
+			}
+		}
 	}
-	js.CopyBytesToGo(s.writeBuffer, src)
-	return s.conn.Write(s.writeBuffer[:length])
+	return jsErrorf(errCodeInvalidArgument, "Unknown exit node %q", exitNode)
 }
 
-func (i *jsIPN) ssh(host, username string, termConfig js.Value) map[string]any {
-	jsSSHSession := &jsSSHSession{
-		jsIPN:      i,
-		host:       host,
-		username:   username,
-		termConfig: termConfig,
+// suggestExitNode returns the exit node editPrefs({ exitNode: "auto" })
+// would select.
+func (i *jsIPN) suggestExitNode() (any, error) {
+	suggestion, err := i.lb.SuggestExitNode()
+	if err != nil {
+		return nil, jsErrorf(errCodeHostUnreachable, "No exit node to suggest: %v", err)
 	}
 
-	go jsSSHSession.Run()
+	res := map[string]any{
+		"id":   string(suggestion.ID),
+		"name": suggestion.Name,
+	}
+	if loc := suggestion.Location; loc.Valid() {
+		res["location"] = map[string]any{
+			"country":     loc.Country(),
+			"countryCode": loc.CountryCode(),
+			"city":        loc.City(),
+			"cityCode":    loc.CityCode(),
+		}
+	}
+	return res, nil
+}
 
-	return map[string]any{
-		"close": js.FuncOf(func(this js.Value, args []js.Value) any {
-			return jsSSHSession.Close() != nil
+// tkaStatus returns the Tailnet Lock state. signCommand is set while this
+// node is locked out and has to be signed by an administrator.
+func (i *jsIPN) tkaStatus() map[string]any {
+	return jsTKAStatus(i.lb.NetworkLockStatus())
+}
+
+func jsTKAStatus(st *ipnstate.NetworkLockStatus) map[string]any {
+	res := map[string]any{
+		"enabled":       st.Enabled,
+		"publicKey":     "",
+		"nodeKey":       "",
+		"nodeKeySigned": st.NodeKeySigned,
+		"canSign":       false,
+		"signCommand":   "",
+		"trustedKeys": mapSlice(st.TrustedKeys, func(k ipnstate.TKAKey) any {
+			return map[string]any{
+				"key":      k.Key.CLIString(),
+				"metadata": jsStringMap(k.Metadata),
+				"votes":    k.Votes,
+			}
 		}),
-		"resize": js.FuncOf(func(this js.Value, args []js.Value) any {
-			rows := args[0].Int()
-			cols := args[1].Int()
-			return jsSSHSession.Resize(rows, cols) != nil
+		"filteredPeers": mapSlice(st.FilteredPeers, func(p *ipnstate.TKAPeer) any {
+			return map[string]any{
+				"id":        strconv.FormatInt(int64(p.ID), 10),
+				"name":      p.Name,
+				"addresses": mapSlice(p.TailscaleIPs, func(a netip.Addr) any { return a.String() }),
+				"nodeKey":   p.NodeKey.String(),
+			}
 		}),
 	}
+	if st.Head != nil {
+		res["head"] = hex.EncodeToString(st.Head[:])
+	}
+	if !st.PublicKey.IsZero() {
+		res["publicKey"] = st.PublicKey.CLIString()
+		res["canSign"] = slices.ContainsFunc(st.TrustedKeys, func(k ipnstate.TKAKey) bool {
+			return k.Key == st.PublicKey
+		})
+	}
+	if st.NodeKey != nil {
+		res["nodeKey"] = st.NodeKey.String()
+		if st.Enabled && !st.NodeKeySigned && !st.PublicKey.IsZero() {
+			res["signCommand"] = fmt.Sprintf("tailscale lock sign %v %s", st.NodeKey, st.PublicKey.CLIString())
+		}
+	}
+	return res
 }
 
-type jsSSHSession struct {
-	jsIPN      *jsIPN
-	host       string
-	username   string
-	termConfig js.Value
-	session    *ssh.Session
+// tkaSign signs the node key of another node with the Tailnet Lock key of
+// this node, which has to be trusted.
+func (i *jsIPN) tkaSign(nodeKeyStr, rotationKeyStr string) error {
+	var nodeKey key.NodePublic
+	if err := nodeKey.UnmarshalText([]byte(nodeKeyStr)); err != nil {
+		return jsErrorf(errCodeInvalidArgument, "Invalid node key: %v", err)
+	}
+	var rotationPublic []byte
+	if rotationKeyStr != "" {
+		var rotationKey key.NLPublic
+		if err := rotationKey.UnmarshalText([]byte(rotationKeyStr)); err != nil {
+			return jsErrorf(errCodeInvalidArgument, "Invalid rotation key: %v", err)
+		}
+		rotationPublic = rotationKey.Verifier()
+	}
 
-	pendingResizeRows int
-	pendingResizeCols int
+	if err := i.lb.NetworkLockSign(nodeKey, rotationPublic); err != nil {
+		if strings.Contains(err.Error(), tsconst.TailnetLockNotTrustedMsg) || !i.lb.NetworkLockStatus().Enabled {
+			return jsErrorf(errCodeNotSupported, "Signing is not available: %v", err)
+		}
+		return err
+	}
+	return nil
 }
 
-func (s *jsSSHSession) Run() {
-	writeFn := s.termConfig.Get("writeFn")
-	writeErrorFn := s.termConfig.Get("writeErrorFn")
-	setReadFn := s.termConfig.Get("setReadFn")
-	rows := s.termConfig.Get("rows").Int()
-	cols := s.termConfig.Get("cols").Int()
-	timeoutSeconds := 5.0
-	if jsTimeoutSeconds := s.termConfig.Get("timeoutSeconds"); jsTimeoutSeconds.Type() == js.TypeNumber {
-		timeoutSeconds = jsTimeoutSeconds.Float()
+var (
+	secretKeyRegexp = regexp.MustCompile(`\b(nodekey|mkey|discokey|nlpub|tlpub|privkey|nlpriv):[0-9a-f]+`)
+	authKeyRegexp   = regexp.MustCompile(`\btskey-[0-9A-Za-z-]+`)
+	authURLRegexp   = regexp.MustCompile(`(https?://\S+?/(?:a|register)/)[0-9A-Za-z_:-]+`)
+)
+
+// redactSecrets replaces keys, auth keys and the login URLs of Tailscale
+// (/a/<id>) and headscale (/register/<id>) in s.
+func redactSecrets(s string) string {
+	s = secretKeyRegexp.ReplaceAllString(s, "$1:REDACTED")
+	s = authKeyRegexp.ReplaceAllString(s, "tskey-REDACTED")
+	return authURLRegexp.ReplaceAllString(s, "${1}REDACTED")
+}
+
+// debugBundle returns a JSON document to attach to bug reports. Keys and
+// login URLs are redacted unless includeSecrets is set.
+func (i *jsIPN) debugBundle(includeSecrets bool) (string, error) {
+	st := i.lb.Status()
+	bundle := map[string]any{
+		"time": time.Now().UTC().Format(time.RFC3339),
+		"version": map[string]any{
+			"tailscale": version.Long(),
+			"go":        runtime.Version(),
+		},
+		"state":       i.lb.State().String(),
+		"prefs":       jsPrefs(i.lb.Prefs()),
+		"health":      jsHealth(i.lb.HealthTracker().CurrentState()),
+		"tka":         i.tkaStatus(),
+		"logs":        logs.recentLines(),
+		"homeDERP":    "",
+		"netMap":      nil,
+		"derpMap":     nil,
+		"sessions":    i.debugSessions(),
+		"authURL":     st.AuthURL,
+		"tailnet":     st.CurrentTailnet,
+		"haveNodeKey": st.HaveNodeKey,
+	}
+	if st.Self != nil {
+		bundle["homeDERP"] = st.Self.Relay
+	}
+	report := i.lastDERPReport.Load()
+	if report == nil {
+		report = i.lb.MagicConn().GetLastNetcheckReport(context.Background())
+	}
+	if dm := i.lb.DERPMap(); dm != nil && report != nil {
+		bundle["derpReport"] = i.jsDERPReport(dm, report)
 	}
-	onConnectionProgress := s.termConfig.Get("onConnectionProgress")
-	onConnected := s.termConfig.Get("onConnected")
-	onDone := s.termConfig.Get("onDone")
-	defer onDone.Invoke()
 
-	writeError := func(label string, err error) {
-		writeErrorFn.Invoke(fmt.Sprintf("%s Error: %v\r\n", label, err))
+	if nm := i.lb.NetMap(); nm != nil {
+		bundle["netMap"] = map[string]any{
+			"self": map[string]any{
+				"name":      nm.SelfNode.Name(),
+				"addresses": mapSliceView(nm.SelfNode.Addresses(), func(a netip.Prefix) string { return a.Addr().String() }),
+				"nodeKey":   nm.SelfNode.Key().String(),
+				"homeDERP":  nm.SelfNode.HomeDERP(),
+			},
+			"domain": nm.Domain,
+			"peers": mapSlice(nm.Peers, func(p tailcfg.NodeView) any {
+				online, _ := p.Online().GetOk()
+				return map[string]any{
+					"id":        strconv.FormatInt(int64(p.ID()), 10),
+					"name":      p.Name(),
+					"addresses": mapSliceView(p.Addresses(), func(a netip.Prefix) string { return a.Addr().String() }),
+					"os":        p.Hostinfo().OS(),
+					"online":    online,
+					"homeDERP":  p.HomeDERP(),
+					"exitNode":  tsaddr.ContainsExitRoutes(p.AllowedIPs()),
+					"nodeKey":   p.Key().String(),
+				}
+			}),
+		}
+		if dm := nm.DERPMap; dm != nil {
+			regions := make([]any, 0, len(dm.Regions))
+			for _, id := range slices.Sorted(maps.Keys(dm.Regions)) {
+				r := dm.Regions[id]
+				regions = append(regions, map[string]any{
+					"id":    id,
+					"code":  r.RegionCode,
+					"name":  r.RegionName,
+					"nodes": len(r.Nodes),
+				})
+			}
+			bundle["derpMap"] = regions
+		}
 	}
-	reportProgress := func(message string) {
-		onConnectionProgress.Invoke(message)
+
+	b, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if includeSecrets {
+		return string(b), nil
 	}
+	return redactSecrets(string(b)), nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds*float64(time.Second)))
+// debugSessions lists the open TCP and SSH sessions for debugBundle.
+func (i *jsIPN) debugSessions() []any {
+	sessions := []any{}
+	i.sessions.Range(func(k, v any) bool {
+		session := v.(activeSession)
+		sessions = append(sessions, map[string]any{
+			"kind":   session.kind,
+			"target": session.target,
+			"stats":  session.stats(),
+		})
+		return true
+	})
+	return sessions
+}
+
+// checkRoute fails fast for destinations outside of the tailnet while no exit
+// node is selected, instead of letting the dial time out.
+func (i *jsIPN) checkRoute(addr netip.Addr) error {
+	if tsaddr.IsTailscaleIP(addr) {
+		return nil
+	}
+	prefs := i.lb.Prefs()
+	if !prefs.ExitNodeID().IsZero() || prefs.ExitNodeIP().IsValid() {
+		return nil
+	}
+	nm := i.lb.NetMap()
+	if nm == nil {
+		return nil
+	}
+	if prefs.RouteAll() {
+		for _, p := range nm.Peers {
+			for _, route := range p.AllowedIPs().All() {
+				if route.Bits() > 0 && route.Contains(addr) {
+					return nil
+				}
+			}
+		}
+	}
+	return jsErrorf(errCodeHostUnreachable, "%v is outside of the tailnet and no exit node is selected", addr)
+}
+
+// ACL verdicts of aclVerdict.
+const (
+	aclAllowed = "allowed"
+	aclDenied  = "denied"
+	aclUnknown = "unknown"
+)
+
+// aclVerdict evaluates whether the peer owning addr is reachable at all.
+// Connections are denied if the peer is not visible, filtered by Tailnet
+// Lock or expired. Anything else is unknown: the packet filter of the netmap
+// is the inbound filter of this node and says nothing about the ports or
+// protocols peers accept.
+func (i *jsIPN) aclVerdict(nm *netmap.NetworkMap, addr netip.Addr) (verdict, reason string) {
+	if nm == nil {
+		return aclUnknown, "No netmap yet"
+	}
+	if slices.ContainsFunc(nm.GetAddresses().AsSlice(), func(p netip.Prefix) bool { return p.Addr() == addr }) {
+		return aclAllowed, "Own address"
+	}
+	if isPeerIP(addr) {
+		peer, ok := nm.PeerByTailscaleIP(addr)
+		switch {
+		case !ok && slices.ContainsFunc(i.lb.NetworkLockStatus().FilteredPeers, func(p *ipnstate.TKAPeer) bool {
+			return slices.Contains(p.TailscaleIPs, addr)
+		}):
+			return aclDenied, fmt.Sprintf("%v is not signed by Tailnet Lock", addr)
+		case !ok:
+			return aclDenied, fmt.Sprintf("No peer with address %v is visible, the policy grants no access to it", addr)
+		case peer.Expired():
+			return aclDenied, fmt.Sprintf("The node key of %s expired", peer.Name())
+		}
+	}
+
+	return aclUnknown, fmt.Sprintf("The policy for %v is enforced by the peer and not known to this node", addr)
+}
+
+// isPeerIP reports whether addr is assigned to a node of the tailnet. 4via6
+// addresses of subnet routers and Quad100 are in the Tailscale range too, but
+// not assigned to a node.
+func isPeerIP(addr netip.Addr) bool {
+	switch {
+	case !tsaddr.IsTailscaleIP(addr),
+		tsaddr.IsViaPrefix(netip.PrefixFrom(addr, addr.BitLen())),
+		addr == tsaddr.TailscaleServiceIP(),
+		addr == tsaddr.TailscaleServiceIPv6():
+		return false
+	}
+	return true
+}
+
+// checkACL fails fast for connections the policy clearly denies, instead of
+// letting the dial time out.
+func (i *jsIPN) checkACL(addr netip.Addr) error {
+	if verdict, reason := i.aclVerdict(i.lb.NetMap(), addr); verdict == aclDenied {
+		return jsErrorf(errCodeACLDenied, "%s", reason)
+	}
+	return nil
+}
+
+var defaultProbePorts = []int{22, 3389, 5900, 5901, 80, 443, 8080}
+
+const defaultProbeTimeout = 3 * time.Second
+
+// probeCache holds probeServices results of open ports until the netmap
+// changes.
+type probeCache struct {
+	mu      sync.Mutex
+	results map[netip.AddrPort]jsProbeResult
+}
+
+func (c *probeCache) get(dst netip.AddrPort) (jsProbeResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.results[dst]
+	return r, ok
+}
+
+func (c *probeCache) set(dst netip.AddrPort, r jsProbeResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.results == nil {
+		c.results = map[netip.AddrPort]jsProbeResult{}
+	}
+	c.results[dst] = r
+}
+
+func (c *probeCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results = nil
+}
+
+type jsProbeResult struct {
+	Port int  `json:"port"`
+	Open bool `json:"open"`
+	// Protocol is ssh, vnc, rdp, http, https or unknown if the port is open.
+	Protocol string `json:"protocol,omitempty"`
+	// Banner is the SSH or RFB version, or the HTTP Server header.
+	Banner string `json:"banner,omitempty"`
+	// Error is the code the dial failed with if the port is not open.
+	Error string `json:"error,omitempty"`
+}
+
+// probeServices dials ports of peer concurrently and detects the protocols
+// behind them by their banners.
+func (i *jsIPN) probeServices(peer string, ports []int, timeout time.Duration) (any, error) {
+	addr := peerAddr(i.lb.NetMap(), peer)
+	if !addr.IsValid() {
+		return nil, jsErrorf(errCodeInvalidArgument, "Unknown peer %q", peer)
+	}
+
+	results := make([]jsProbeResult, len(ports))
+	var wg sync.WaitGroup
+	for n, port := range ports {
+		dst := netip.AddrPortFrom(addr, uint16(port))
+		if r, ok := i.probes.get(dst); ok {
+			results[n] = r
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[n] = i.probe(dst, timeout)
+			// A failed dial may be a timeout that was too short, try again
+			// next time.
+			if results[n].Open {
+				i.probes.set(dst, results[n])
+			}
+		}()
+	}
+	wg.Wait()
+
+	b, err := json.Marshal(results)
+	if err != nil {
+		return nil, err
+	}
+	return js.Global().Get("JSON").Call("parse", string(b)), nil
+}
+
+// rdpConnectionRequest is an X.224 Connection Request with an RDP
+// Negotiation Request for TLS and CredSSP.
+var rdpConnectionRequest = []byte{
+	0x03, 0x00, 0x00, 0x13, // TPKT
+	0x0e, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00, // X.224
+	0x01, 0x00, 0x08, 0x00, 0x03, 0x00, 0x00, 0x00, // RDP_NEG_REQ
+}
+
+func (i *jsIPN) probe(dst netip.AddrPort, timeout time.Duration) jsProbeResult {
+	r := jsProbeResult{Port: int(dst.Port())}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	reportProgress(fmt.Sprintf("Connecting to %s…", strings.Split(s.host, ".")[0]))
-	c, err := s.jsIPN.dialer.UserDial(ctx, "tcp", net.JoinHostPort(s.host, "22"))
+
+	conn, err := i.dialer.UserDial(ctx, "tcp", dst.String())
 	if err != nil {
-		writeError("Dial", err)
-		return
+		r.Error = errorCode(err)
+		return r
 	}
-	defer c.Close()
+	defer conn.Close()
+	r.Open = true
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
 
-	config := &ssh.ClientConfig{
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// Host keys are not used with Tailscale SSH, but we can use this
-			// callback to know that the connection has been established.
-			reportProgress("SSH connection established…")
-			return nil
-		},
-		User: s.username,
+	// SSH and VNC servers speak first.
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(min(timeout/2, time.Second)))
+	if n, _ := conn.Read(buf); n > 0 {
+		banner := strings.TrimSpace(string(buf[:n]))
+		banner, _, _ = strings.Cut(banner, "\n")
+		switch {
+		case strings.HasPrefix(banner, "SSH-"):
+			r.Protocol = "ssh"
+		case strings.HasPrefix(banner, "RFB "):
+			r.Protocol = "vnc"
+		default:
+			r.Protocol = "unknown"
+		}
+		r.Banner = strings.TrimSpace(banner)
+		return r
 	}
+	conn.SetDeadline(deadline)
 
-	reportProgress("Starting SSH client…")
-	sshConn, _, _, err := ssh.NewClientConn(c, s.host, config)
+	switch dst.Port() {
+	case 3389:
+		if _, err := conn.Write(rdpConnectionRequest); err != nil {
+			break
+		}
+		// TPKT header followed by an X.224 Connection Confirm.
+		if n, _ := io.ReadFull(conn, buf[:6]); n == 6 && buf[0] == 0x03 && buf[5]&0xf0 == 0xd0 {
+			r.Protocol = "rdp"
+			return r
+		}
+	case 443, 8443:
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: dst.Addr().String(), InsecureSkipVerify: true})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			break
+		}
+		if server, ok := probeHTTP(tlsConn, dst); ok {
+			r.Protocol, r.Banner = "https", server
+			return r
+		}
+	default:
+		if server, ok := probeHTTP(conn, dst); ok {
+			r.Protocol, r.Banner = "http", server
+			return r
+		}
+	}
+	r.Protocol = "unknown"
+	return r
+}
+
+// probeHTTP sends a HEAD request and returns the Server header.
+func probeHTTP(conn net.Conn, dst netip.AddrPort) (server string, ok bool) {
+	req, err := http.NewRequest(http.MethodHead, "http://"+dst.String()+"/", nil)
 	if err != nil {
-		writeError("SSH Connection", err)
-		return
+		return "", false
 	}
-	defer sshConn.Close()
+	if err := req.Write(conn); err != nil {
+		return "", false
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return "", false
+	}
+	res.Body.Close()
+	return res.Header.Get("Server"), true
+}
 
-	sshClient := ssh.NewClient(sshConn, nil, nil)
-	defer sshClient.Close()
+const (
+	defaultPingCount   = 10
+	defaultPingTimeout = 5 * time.Second
+	pingInterval       = time.Second
+)
 
-	session, err := sshClient.NewSession()
-	if err != nil {
-		writeError("SSH Session", err)
-		return
+// ping is the equivalent of `tailscale ping`. Like the CLI it stops at the
+// first direct pong unless untilDirect is false, onAttempt is called with
+// each attempt.
+func (i *jsIPN) ping(peer string, pingType tailcfg.PingType, count int, timeout time.Duration, untilDirect bool, onAttempt js.Value) (any, error) {
+	addr := peerAddr(i.lb.NetMap(), peer)
+	if !addr.IsValid() {
+		return nil, jsErrorf(errCodeInvalidArgument, "Unknown peer %q", peer)
+	}
+
+	attempts := []any{}
+	direct := false
+	for seq := range count {
+		if seq > 0 {
+			time.Sleep(pingInterval)
+		}
+		attempt := i.pingOnce(addr, pingType, timeout)
+		attempt["seq"] = seq
+		attempts = append(attempts, attempt)
+		if onAttempt.Type() == js.TypeFunction {
+			onAttempt.Invoke(attempt)
+		}
+		if err, ok := attempt["error"].(string); ok && err == errCodeInvalidArgument {
+			break
+		}
+		if attempt["path"] == "direct" {
+			direct = true
+			if untilDirect {
+				break
+			}
+		}
+	}
+	return map[string]any{
+		"address":  addr.String(),
+		"type":     string(pingType),
+		"direct":   direct,
+		"attempts": attempts,
+	}, nil
+}
+
+func (i *jsIPN) pingOnce(addr netip.Addr, pingType tailcfg.PingType, timeout time.Duration) map[string]any {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	res, err := i.lb.Ping(ctx, addr, pingType, 0)
+	if err != nil {
+		return map[string]any{"error": errorCode(err), "message": err.Error()}
+	}
+	if res.Err != "" {
+		code := errCodeIO
+		if res.IsLocalIP {
+			code = errCodeInvalidArgument
+		}
+		return map[string]any{"error": code, "message": res.Err}
+	}
+
+	attempt := map[string]any{
+		"latencyMs": res.LatencySeconds * 1000,
+		"nodeName":  res.NodeName,
+		"nodeIP":    res.NodeIP,
+	}
+	switch {
+	case res.Endpoint != "":
+		attempt["path"] = "direct"
+		attempt["endpoint"] = res.Endpoint
+	case res.DERPRegionID != 0:
+		attempt["path"] = "derp"
+		attempt["derpRegion"] = map[string]any{
+			"id":   res.DERPRegionID,
+			"code": res.DERPRegionCode,
+		}
+	default:
+		// TSMP and ICMP pongs do not tell the path.
+		attempt["path"] = "unknown"
+	}
+	if res.PeerAPIPort != 0 {
+		attempt["peerAPIPort"] = res.PeerAPIPort
+	}
+	return attempt
+}
+
+const derpReportTimeout = 10 * time.Second
+
+// derpReport measures the HTTPS latency from the browser to each DERP region.
+// It resolves with the regions by latency and the current home region.
+func (i *jsIPN) derpReport() (any, error) {
+	dm := i.lb.DERPMap()
+	if dm == nil {
+		return nil, jsErrorf(errCodeNotRunning, "No DERP map yet")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), derpReportTimeout)
+	defer cancel()
+
+	nc := &netcheck.Client{
+		NetMon: i.lb.NetMon(),
+		Logf:   logs.logf("netcheck"),
+	}
+	report, err := nc.GetReport(ctx, dm, nil)
+	if err != nil {
+		return nil, err
+	}
+	i.lastDERPReport.Store(report)
+	return i.jsDERPReport(dm, report), nil
+}
+
+// jsDERPReport lists the regions of dm with their latency in report, fastest
+// first and unreachable regions last.
+func (i *jsIPN) jsDERPReport(dm *tailcfg.DERPMap, report *netcheck.Report) map[string]any {
+	regions := slices.Collect(maps.Values(dm.Regions))
+	slices.SortFunc(regions, func(a, b *tailcfg.DERPRegion) int {
+		latA, okA := report.RegionLatency[a.RegionID]
+		latB, okB := report.RegionLatency[b.RegionID]
+		switch {
+		case okA != okB:
+			if okA {
+				return -1
+			}
+			return 1
+		case latA != latB:
+			return cmp.Compare(latA, latB)
+		default:
+			return cmp.Compare(a.RegionID, b.RegionID)
+		}
+	})
+
+	home := 0
+	if nm := i.lb.NetMap(); nm != nil {
+		home = nm.SelfNode.HomeDERP()
+	}
+	return map[string]any{
+		"time":            report.Now.UnixMilli(),
+		"homeRegion":      home,
+		"preferredRegion": report.PreferredDERP,
+		"pinnedRegion":    i.preferredDERP,
+		"regions": mapSlice(regions, func(r *tailcfg.DERPRegion) any {
+			var latency any
+			if l, ok := report.RegionLatency[r.RegionID]; ok {
+				latency = float64(l) / float64(time.Millisecond)
+			}
+			return map[string]any{
+				"id":        r.RegionID,
+				"code":      r.RegionCode,
+				"name":      r.RegionName,
+				"latencyMs": latency,
+			}
+		}),
+	}
+}
+
+// peerAddr returns the address of peer, which is an IP, a node ID, a stable
+// node ID, a MagicDNS name or a hostname. It is invalid if the peer is unknown.
+func peerAddr(nm *netmap.NetworkMap, peer string) netip.Addr {
+	if addr, err := netip.ParseAddr(peer); err == nil {
+		return addr
+	}
+	if nm == nil {
+		return netip.Addr{}
+	}
+	for _, p := range nm.Peers {
+		if strconv.FormatInt(int64(p.ID()), 10) == peer || string(p.StableID()) == peer ||
+			connectionMatchesPeer(jsConnectionPreset{Peer: peer}, p) {
+			if p.Addresses().Len() > 0 {
+				return p.Addresses().At(0).Addr()
+			}
+			break
+		}
+	}
+	return netip.Addr{}
+}
+
+// canConnect reports whether peer is reachable at all, peer is an IP, a node
+// ID, a stable node ID, a MagicDNS name or a hostname.
+func (i *jsIPN) canConnect(peer string) (any, error) {
+	nm := i.lb.NetMap()
+	addr := peerAddr(nm, peer)
+	if !addr.IsValid() {
+		return map[string]any{
+			"result":  aclUnknown,
+			"reason":  fmt.Sprintf("Unknown peer %q", peer),
+			"address": "",
+		}, nil
+	}
+
+	verdict, reason := i.aclVerdict(nm, addr)
+	return map[string]any{
+		"result":  verdict,
+		"reason":  reason,
+		"address": addr.String(),
+	}, nil
+}
+
+func (i *jsIPN) jsProfile(p ipn.LoginProfileView, current bool) map[string]any {
+	profile := map[string]any{
+		"id":         string(p.ID()),
+		"name":       p.Name(),
+		"controlURL": p.ControlURL(),
+		"userLogin":  p.UserProfile().LoginName,
+		"tailnet":    p.NetworkProfile().DomainName,
+		"nodeName":   "",
+		"current":    current,
+	}
+	// Only the netmap of the current profile is known.
+	if current {
+		if nm := i.lb.NetMap(); nm != nil {
+			profile["nodeName"] = nm.Name
+		}
+	}
+	return profile
+}
+
+func (i *jsIPN) tcp(config js.Value) any {
+	return makePromise(func() (any, error) {
+		if err := i.checkRunning(); err != nil {
+			return nil, err
+		}
+		jsTCPSession, err := i.newJSTCPSession(config)
+		if err != nil {
+			return nil, err
+		}
+
+		jsObjectWrapper := jsTCPSession.jsWrapper()
+		return jsObjectWrapper, nil
+	})
+}
+
+const defaultTCPConnectTimeoutSeconds = 5 * time.Second
+const defaultTCPWriteBufferSizeBytes = 1 << 20
+const defaultTCPMaxWriteQueueSizeBytes = 16 << 20
+const defaultTCPReadBufferSizeBytes = 1 << 20
+const defaultTCPReadCoalesceDelay = 5 * time.Millisecond
+
+// Read modes of a TCP session.
+const (
+	// tcpReadModeShared delivers every chunk as a subarray of one Uint8Array
+	// that is overwritten by the next read.
+	tcpReadModeShared = "shared"
+	// tcpReadModeOwned delivers every chunk in a fresh Uint8Array that the
+	// JS side may keep.
+	tcpReadModeOwned = "owned"
+	// tcpReadModePooled delivers every chunk in a Uint8Array that the JS side
+	// owns until it hands it back with release(), then it is reused.
+	tcpReadModePooled = "pooled"
+)
+
+// maxTCPReadPoolSize bounds the released buffers kept per session in pooled
+// read mode.
+const maxTCPReadPoolSize = 8
+
+type jsTCPSessionBuilder struct {
+	jsIPN                *jsIPN
+	addr                 string
+	readCallback         func(js.Value)
+	backpressureCallback func(bool)
+	closeCallback        func(jsTCPCloseReason)
+	errorCallback        func(jsTCPCloseReason)
+	statsCallback        js.Value
+	statsInterval        time.Duration
+	writeBufferSize      int
+	maxWriteQueueSize    int
+	readBufferSize       int
+	readMode             string
+	readCoalesceBytes    int
+	readCoalesceDelay    time.Duration
+	connectTimeout       time.Duration
+}
+
+func (i *jsIPN) newJSTCPSession(config js.Value) (*jsTCPSession, error) {
+	builder := jsTCPSessionBuilder{
+		jsIPN:             i,
+		writeBufferSize:   defaultTCPWriteBufferSizeBytes,
+		maxWriteQueueSize: defaultTCPMaxWriteQueueSizeBytes,
+		readBufferSize:    defaultTCPReadBufferSizeBytes,
+		readMode:          tcpReadModeShared,
+		readCoalesceDelay: defaultTCPReadCoalesceDelay,
+		connectTimeout:    defaultTCPConnectTimeoutSeconds,
+	}
+
+	if err := builder.setAddr(config); err != nil {
+		return nil, err
+	}
+	if err := builder.setReadCallback(config); err != nil {
+		return nil, err
+	}
+	builder.setBufferSizes(config)
+	if err := builder.setReadMode(config); err != nil {
+		return nil, err
+	}
+	builder.setBackpressureCallback(config)
+	builder.setCloseCallbacks(config)
+	builder.statsCallback, builder.statsInterval = statsCallbackOption(config)
+	builder.setConnectTimeout(config)
+
+	return builder.connect()
+}
+
+func (b *jsTCPSessionBuilder) setAddr(config js.Value) error {
+	jsHostname := config.Get("hostname")
+	if jsHostname.Type() != js.TypeString {
+		return jsErrorf(errCodeInvalidArgument, "Hostname must be a string")
+	}
+
+	jsPort := config.Get("port")
+	if jsPort.Type() != js.TypeNumber {
+		return jsErrorf(errCodeInvalidArgument, "Port must be a number")
+	}
+	if jsPort.Int() < 1 || jsPort.Int() > 65535 {
+		return jsErrorf(errCodeInvalidArgument, "Port must be between 1 and 65535")
+	}
+	port := strconv.Itoa(jsPort.Int())
+	b.addr = net.JoinHostPort(jsHostname.String(), port)
+
+	return nil
+}
+
+func (b *jsTCPSessionBuilder) setReadCallback(config js.Value) error {
+	jsReadCallback := config.Get("readCallback")
+	if jsReadCallback.Type() != js.TypeFunction {
+		return jsErrorf(errCodeInvalidArgument, "Invalid readCallback received")
+	}
+	b.readCallback = func(subarray js.Value) {
+		jsReadCallback.Invoke(subarray)
+	}
+
+	return nil
+}
+
+func (b *jsTCPSessionBuilder) setBufferSizes(config js.Value) {
+	if jsWriteBufferSize := config.Get("writeBufferSizeInBytes"); jsWriteBufferSize.Type() == js.TypeNumber {
+		b.writeBufferSize = jsWriteBufferSize.Int()
+	}
+
+	if jsMaxWriteQueueSize := config.Get("maxWriteQueueSizeInBytes"); jsMaxWriteQueueSize.Type() == js.TypeNumber {
+		b.maxWriteQueueSize = jsMaxWriteQueueSize.Int()
+	}
+	if b.maxWriteQueueSize < b.writeBufferSize {
+		b.maxWriteQueueSize = b.writeBufferSize
+	}
+
+	// ReadBufferSizeInBytes is the historic spelling, still accepted.
+	for _, key := range []string{"readBufferSizeInBytes", "ReadBufferSizeInBytes"} {
+		if jsReadBufferSize := config.Get(key); jsReadBufferSize.Type() == js.TypeNumber {
+			b.readBufferSize = jsReadBufferSize.Int()
+			break
+		}
+	}
+}
+
+func (b *jsTCPSessionBuilder) setReadMode(config js.Value) error {
+	if jsReadMode := config.Get("readMode"); jsReadMode.Type() == js.TypeString {
+		switch mode := jsReadMode.String(); mode {
+		case tcpReadModeShared, tcpReadModeOwned, tcpReadModePooled:
+			b.readMode = mode
+		default:
+			return jsErrorf(errCodeInvalidArgument, "Invalid readMode %q", mode)
+		}
+	}
+
+	if jsCoalesceBytes := config.Get("readCoalesceBytes"); jsCoalesceBytes.Type() == js.TypeNumber {
+		b.readCoalesceBytes = min(jsCoalesceBytes.Int(), b.readBufferSize)
+	}
+	if jsCoalesceDelay := config.Get("readCoalesceDelayMs"); jsCoalesceDelay.Type() == js.TypeNumber {
+		b.readCoalesceDelay = time.Duration(jsCoalesceDelay.Float() * float64(time.Millisecond))
+	}
+
+	return nil
+}
+
+func (b *jsTCPSessionBuilder) setBackpressureCallback(config js.Value) {
+	if jsBackpressureCallback := config.Get("onBackpressure"); jsBackpressureCallback.Type() == js.TypeFunction {
+		b.backpressureCallback = func(active bool) {
+			jsBackpressureCallback.Invoke(active)
+		}
+	}
+}
+
+func (b *jsTCPSessionBuilder) setCloseCallbacks(config js.Value) {
+	if jsCloseCallback := config.Get("onClose"); jsCloseCallback.Type() == js.TypeFunction {
+		b.closeCallback = func(reason jsTCPCloseReason) {
+			jsCloseCallback.Invoke(reason.toJS())
+		}
+	}
+	if jsErrorCallback := config.Get("onError"); jsErrorCallback.Type() == js.TypeFunction {
+		b.errorCallback = func(reason jsTCPCloseReason) {
+			jsErrorCallback.Invoke(reason.toJS())
+		}
+	}
+}
+
+func (b *jsTCPSessionBuilder) setConnectTimeout(config js.Value) {
+	if jsConnectTimeout := config.Get("connectTimeout"); jsConnectTimeout.Type() == js.TypeNumber {
+		b.connectTimeout = time.Duration(jsConnectTimeout.Float() * float64(time.Second))
+	}
+}
+
+func (b *jsTCPSessionBuilder) connect() (*jsTCPSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.connectTimeout)
+	defer cancel()
+
+	conn, err := b.jsIPN.dialer.UserDial(ctx, "tcp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &jsTCPSession{
+		jsIPN:             b.jsIPN,
+		conn:              conn,
+		writeQueue:        newJSTCPWriteQueue(b.writeBufferSize, b.maxWriteQueueSize, b.backpressureCallback),
+		readBuffer:        make([]byte, b.readBufferSize),
+		readCallback:      b.readCallback,
+		readMode:          b.readMode,
+		readCoalesceBytes: b.readCoalesceBytes,
+		readCoalesceDelay: b.readCoalesceDelay,
+		closeCallback:     b.closeCallback,
+		errorCallback:     b.errorCallback,
+		stats:             newSessionStats(conn.RemoteAddr()),
+		done:              make(chan struct{}),
+	}
+	s.closed, s.resolveClosed, _ = newPromise()
+	b.jsIPN.sessions.Store(s.stats, activeSession{"tcp", b.addr, s.statsJS})
+
+	go s.readLoop()
+	go s.writeLoop()
+	if b.statsCallback.Type() == js.TypeFunction {
+		go reportStats(s.done, b.statsInterval, b.statsCallback, s.statsJS)
+	}
+
+	return s, nil
+}
+
+type jsTCPSession struct {
+	jsIPN             *jsIPN
+	conn              net.Conn
+	writeQueue        *jsTCPWriteQueue
+	readBuffer        []byte
+	readCallback      func(js.Value)
+	readMode          string
+	readCoalesceBytes int
+	readCoalesceDelay time.Duration
+
+	readMu     sync.Mutex
+	readPaused bool
+	readResume chan struct{}
+
+	// readPool holds the buffers released in pooled read mode.
+	readPoolMu sync.Mutex
+	readPool   []js.Value
+
+	closeOnce     sync.Once
+	closeCallback func(jsTCPCloseReason)
+	errorCallback func(jsTCPCloseReason)
+	closed        js.Value
+	resolveClosed func(any)
+
+	stats *sessionStats
+	// done is closed once the session is shut down.
+	done chan struct{}
+}
+
+type jsTCPCloseReason struct {
+	code    string
+	message string
+}
+
+func (r jsTCPCloseReason) toJS() map[string]any {
+	return map[string]any{
+		"code":    r.code,
+		"message": r.message,
+	}
+}
+
+// tcpCloseReasonFor classifies the error that ended a session.
+func tcpCloseReasonFor(err error) jsTCPCloseReason {
+	if errors.Is(err, io.EOF) {
+		return jsTCPCloseReason{errCodeEOF, "Connection closed by remote"}
+	}
+	return jsTCPCloseReason{errorCode(err), err.Error()}
+}
+
+// jsTCPWrite is a single JS write() call waiting to be written to the conn.
+type jsTCPWrite struct {
+	data []byte
+	// closeWrite marks a closeWrite() call, which is processed in order
+	// with the writes before it.
+	closeWrite bool
+	resolve    func(any)
+	reject     func(error)
+}
+
+// jsTCPWriteQueue serializes writes to a session, so that concurrent write()
+// calls from JS can neither interleave nor reorder. Once the queued bytes
+// exceed the high-water mark, onBackpressure(true) asks JS to pause its
+// producers, onBackpressure(false) follows once the queue has drained to a
+// quarter of it. Writes exceeding maxSize are rejected.
+type jsTCPWriteQueue struct {
+	highWaterMark  int
+	lowWaterMark   int
+	maxSize        int
+	onBackpressure func(bool)
+
+	mu           sync.Mutex
+	pending      []*jsTCPWrite
+	queuedBytes  int
+	backpressure bool
+	writeClosed  bool
+	closed       bool
+	wake         chan struct{}
+}
+
+var errTCPWriteQueueFull = jsErrorf(errCodeQueueFull, "Write queue is full")
+var errTCPSessionClosed = jsErrorf(errCodeClosed, "Session is closed")
+var errTCPWriteClosed = jsErrorf(errCodeClosed, "Write side of the session is closed")
+
+func newJSTCPWriteQueue(highWaterMark, maxSize int, onBackpressure func(bool)) *jsTCPWriteQueue {
+	return &jsTCPWriteQueue{
+		highWaterMark:  highWaterMark,
+		lowWaterMark:   highWaterMark / 4,
+		maxSize:        maxSize,
+		onBackpressure: onBackpressure,
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+// push enqueues w. A write larger than maxSize is still accepted into an
+// empty queue, otherwise it could never be written.
+func (q *jsTCPWriteQueue) push(w *jsTCPWrite) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return errTCPSessionClosed
+	}
+	if q.writeClosed {
+		q.mu.Unlock()
+		return errTCPWriteClosed
+	}
+	if q.queuedBytes > 0 && q.queuedBytes+len(w.data) > q.maxSize {
+		q.mu.Unlock()
+		return errTCPWriteQueueFull
+	}
+	if w.closeWrite {
+		q.writeClosed = true
+	}
+	q.pending = append(q.pending, w)
+	q.queuedBytes += len(w.data)
+	notify := !q.backpressure && q.queuedBytes >= q.highWaterMark
+	if notify {
+		q.backpressure = true
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	if notify && q.onBackpressure != nil {
+		q.onBackpressure(true)
+	}
+	return nil
+}
+
+// next blocks until a write is queued. It returns nil once the queue is
+// closed.
+func (q *jsTCPWriteQueue) next() *jsTCPWrite {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil
+		}
+		if len(q.pending) > 0 {
+			w := q.pending[0]
+			q.pending[0] = nil
+			q.pending = q.pending[1:]
+			q.mu.Unlock()
+			return w
+		}
+		q.mu.Unlock()
+		<-q.wake
+	}
+}
+
+// done marks n bytes of a popped write as handled.
+func (q *jsTCPWriteQueue) done(n int) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.queuedBytes -= n
+	notify := q.backpressure && q.queuedBytes <= q.lowWaterMark
+	if notify {
+		q.backpressure = false
+	}
+	q.mu.Unlock()
+
+	if notify && q.onBackpressure != nil {
+		q.onBackpressure(false)
+	}
+}
+
+// bufferedAmount returns the number of bytes waiting to be written.
+func (q *jsTCPWriteQueue) bufferedAmount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queuedBytes
+}
+
+// close rejects all pending writes and stops the write loop.
+func (q *jsTCPWriteQueue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	pending := q.pending
+	q.pending = nil
+	q.queuedBytes = 0
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	for _, w := range pending {
+		w.reject(errTCPSessionClosed)
+	}
+}
+
+func (s *jsTCPSession) readLoop() {
+	dst := js.Global().Get("Uint8Array").New(len(s.readBuffer))
+
+	// in shared mode we always reuse the same dst but make use of subarrays
+	subarray := dst.Call("subarray", 0, len(s.readBuffer))
+	subarrayLength := len(s.readBuffer)
+	for {
+		s.waitReadable()
+
+		n, err := s.read()
+		if n > 0 {
+			// pause() may have been called while the read was blocked.
+			s.waitReadable()
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+
+			s.stats.received(n)
+			switch s.readMode {
+			case tcpReadModeOwned:
+				chunk := js.Global().Get("Uint8Array").New(n)
+				js.CopyBytesToJS(chunk, s.readBuffer[:n])
+				s.readCallback(chunk)
+			case tcpReadModePooled:
+				chunk := s.pooledReadBuffer().Call("subarray", 0, n)
+				js.CopyBytesToJS(chunk, s.readBuffer[:n])
+				s.readCallback(chunk)
+			default:
+				// if subarray is not already the correct length,
+				// create a new one from dst with correct len
+				if subarrayLength != n {
+					subarrayLength = n
+					subarray = dst.Call("subarray", 0, n)
+				}
+
+				js.CopyBytesToJS(subarray, s.readBuffer[:n])
+
+				s.readCallback(subarray)
+			}
+		}
+		if err != nil {
+			reason := tcpCloseReasonFor(err)
+			if reason.code != errCodeEOF {
+				logs.warnf("read error: %v", err)
+			}
+			// A no-op if the session was closed locally, which is what
+			// made the read fail.
+			s.shutdown(reason, reason.code != errCodeEOF)
+			return
+		}
+	}
+}
+
+// read fills readBuffer. Small reads are coalesced until readCoalesceBytes
+// are available or readCoalesceDelay passed, to save Go to JS calls.
+func (s *jsTCPSession) read() (int, error) {
+	n, err := s.conn.Read(s.readBuffer)
+	if err != nil || n >= s.readCoalesceBytes {
+		return n, err
+	}
+
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.readCoalesceDelay)); err != nil {
+		return n, nil
+	}
+	defer s.conn.SetReadDeadline(time.Time{})
+
+	for n < s.readCoalesceBytes {
+		m, err := s.conn.Read(s.readBuffer[n:])
+		n += m
+		if err != nil {
+			if isTimeout(err) {
+				return n, nil
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// isTimeout reports whether err is a deadline error. Netstack conns do not
+// return os.ErrDeadlineExceeded but a net.Error with Timeout set.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// pauseReads stops reading from the conn, so that TCP flow control slows down
+// the remote side until resumeReads is called.
+func (s *jsTCPSession) pauseReads() {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if !s.readPaused {
+		s.readPaused = true
+		s.readResume = make(chan struct{})
+	}
+}
+
+func (s *jsTCPSession) resumeReads() {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if s.readPaused {
+		s.readPaused = false
+		close(s.readResume)
+	}
+}
+
+// pooledReadBuffer returns a released buffer, or a new one if there is none.
+func (s *jsTCPSession) pooledReadBuffer() js.Value {
+	s.readPoolMu.Lock()
+	defer s.readPoolMu.Unlock()
+	if n := len(s.readPool); n > 0 {
+		buf := s.readPool[n-1]
+		s.readPool = s.readPool[:n-1]
+		return buf
+	}
+	return js.Global().Get("Uint8Array").New(len(s.readBuffer))
+}
+
+// releaseReadBuffer returns a chunk delivered in pooled read mode to the pool.
+func (s *jsTCPSession) releaseReadBuffer(chunk js.Value) error {
+	if !chunk.InstanceOf(js.Global().Get("Uint8Array")) {
+		return jsErrorf(errCodeInvalidArgument, "release() expects a Uint8Array")
+	}
+	buf := js.Global().Get("Uint8Array").New(chunk.Get("buffer"))
+	if buf.Length() != len(s.readBuffer) {
+		return jsErrorf(errCodeInvalidArgument, "Chunk was not delivered in pooled read mode")
+	}
+	s.readPoolMu.Lock()
+	defer s.readPoolMu.Unlock()
+	if len(s.readPool) < maxTCPReadPoolSize {
+		s.readPool = append(s.readPool, buf)
+	}
+	return nil
+}
+
+func (s *jsTCPSession) waitReadable() {
+	s.readMu.Lock()
+	paused, resume := s.readPaused, s.readResume
+	s.readMu.Unlock()
+	if paused {
+		<-resume
+	}
+}
+
+func (s *jsTCPSession) jsWrapper() any {
+	return map[string]any{
+		"remoteAddr": s.conn.RemoteAddr().String(),
+		/**
+		 * Resolves with { code, message } once the connection is closed,
+		 * never rejects
+		 */
+		"closed": s.closed,
+		/**
+		 * Half-closes the connection after all queued writes, reading
+		 * continues until the remote side closes
+		 *
+		 * @returns Promise<void>
+		 */
+		"closeWrite": js.FuncOf(func(this js.Value, args []js.Value) any {
+			promise, resolve, reject := newPromise()
+			if err := s.writeQueue.push(&jsTCPWrite{closeWrite: true, resolve: resolve, reject: reject}); err != nil {
+				reject(err)
+			}
+			return promise
+		}),
+		/**
+		 * Closes the TCP connetion
+		 *
+		 * @returns Promise<void>
+		 */
+		"close": js.FuncOf(func(this js.Value, args []js.Value) any {
+			return makePromise(func() (any, error) {
+				err := s.close()
+				return nil, err
+			})
+		}),
+		/**
+		 * Write to the TCP connection. Writes are queued and written in
+		 * order, the returned promises resolve in the same order.
+		 *
+		 * @param src Uint8Array
+		 * @returns Promise<number> of bytes written
+		 */
+		"write": js.FuncOf(func(this js.Value, args []js.Value) any {
+			promise, resolve, reject := newPromise()
+			if len(args) != 1 {
+				reject(jsErrorf(errCodeInvalidArgument, "Did not receive src argument"))
+				return promise
+			}
+			src := args[0]
+			byteLength := src.Get("byteLength")
+			if byteLength.Type() != js.TypeNumber {
+				reject(jsErrorf(errCodeInvalidArgument, "Invalid type has no byteLength"))
+				return promise
+			}
+			// The JS side is free to reuse src once write() returns, copy it
+			// right away.
+			data := make([]byte, byteLength.Int())
+			js.CopyBytesToGo(data, src)
+			if err := s.writeQueue.push(&jsTCPWrite{data: data, resolve: resolve, reject: reject}); err != nil {
+				reject(err)
+			}
+			return promise
+		}),
+		/**
+		 * Stops delivering data to readCallback. The remote side is slowed
+		 * down by TCP flow control until resume() is called.
+		 */
+		"pause": js.FuncOf(func(this js.Value, args []js.Value) any {
+			s.pauseReads()
+			return nil
+		}),
+		/**
+		 * Resumes delivering data to readCallback after pause()
+		 */
+		"resume": js.FuncOf(func(this js.Value, args []js.Value) any {
+			s.resumeReads()
+			return nil
+		}),
+		/**
+		 * Hands a chunk delivered in pooled read mode back for reuse. The
+		 * chunk must not be used afterwards.
+		 *
+		 * @param chunk Uint8Array
+		 */
+		"release": jsFunc(func(args []js.Value) (any, error) {
+			if len(args) != 1 {
+				return nil, jsErrorf(errCodeInvalidArgument, "Did not receive chunk argument")
+			}
+			return nil, s.releaseReadBuffer(args[0])
+		}),
+		/**
+		 * Bytes queued by write() but not yet written to the connection
+		 *
+		 * @returns number
+		 */
+		"bufferedAmount": js.FuncOf(func(this js.Value, args []js.Value) any {
+			return s.writeQueue.bufferedAmount()
+		}),
+		/**
+		 * Traffic statistics and the path to the peer
+		 *
+		 * @returns IPNSessionStats
+		 */
+		"stats": js.FuncOf(func(this js.Value, args []js.Value) any {
+			return s.statsJS()
+		}),
+	}
+}
+
+// writeLoop writes queued data to the conn one write at a time.
+func (s *jsTCPSession) writeLoop() {
+	for {
+		w := s.writeQueue.next()
+		if w == nil {
+			return
+		}
+		if w.closeWrite {
+			cw, ok := s.conn.(interface{ CloseWrite() error })
+			if !ok {
+				w.reject(jsErrorf(errCodeNotSupported, "Connection does not support closeWrite"))
+				continue
+			}
+			if err := cw.CloseWrite(); err != nil {
+				w.reject(err)
+				continue
+			}
+			w.resolve(nil)
+			continue
+		}
+		n, err := s.conn.Write(w.data)
+		s.writeQueue.done(len(w.data))
+		if err != nil {
+			w.reject(err)
+			s.shutdown(tcpCloseReasonFor(err), true)
+			return
+		}
+		s.stats.sent(n)
+		w.resolve(n)
+	}
+}
+
+func (s *jsTCPSession) statsJS() map[string]any {
+	stats := s.stats.toJS(s.jsIPN)
+	stats["writeQueueBytes"] = s.writeQueue.bufferedAmount()
+	return stats
+}
+
+func (s *jsTCPSession) close() error {
+	return s.shutdown(jsTCPCloseReason{errCodeLocalClose, "Closed locally"}, false)
+}
+
+// shutdown closes the session once and reports reason to JS. Errors are
+// reported to onError as well, before onClose.
+func (s *jsTCPSession) shutdown(reason jsTCPCloseReason, isError bool) error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.writeQueue.close()
+		err = s.conn.Close()
+		// Unblock a paused readLoop, its next read fails on the closed conn.
+		s.resumeReads()
+		close(s.done)
+		s.jsIPN.sessions.Delete(s.stats)
+
+		if isError && s.errorCallback != nil {
+			s.errorCallback(reason)
+		}
+		if s.closeCallback != nil {
+			s.closeCallback(reason)
+		}
+		s.resolveClosed(reason.toJS())
+	})
+	return err
+}
+
+const defaultStatsInterval = time.Second
+
+// sessionStats counts the traffic of a TCP or SSH session. Messages are
+// write() calls and readCallback invocations for TCP, input and output chunks
+// for SSH.
+type sessionStats struct {
+	createdAt        time.Time
+	bytesSent        atomic.Int64
+	bytesReceived    atomic.Int64
+	messagesSent     atomic.Int64
+	messagesReceived atomic.Int64
+	// lastActivity is in unix milliseconds.
+	lastActivity atomic.Int64
+
+	mu   sync.Mutex
+	peer netip.Addr
+}
+
+func newSessionStats(remote net.Addr) *sessionStats {
+	st := &sessionStats{createdAt: time.Now()}
+	st.lastActivity.Store(st.createdAt.UnixMilli())
+	if remote != nil {
+		st.setPeer(remote)
+	}
+	return st
+}
+
+func (st *sessionStats) setPeer(remote net.Addr) {
+	addrPort, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return
+	}
+	st.mu.Lock()
+	st.peer = addrPort.Addr().Unmap()
+	st.mu.Unlock()
+}
+
+func (st *sessionStats) sent(n int) {
+	st.bytesSent.Add(int64(n))
+	st.messagesSent.Add(1)
+	st.lastActivity.Store(time.Now().UnixMilli())
+}
+
+func (st *sessionStats) received(n int) {
+	st.bytesReceived.Add(int64(n))
+	st.messagesReceived.Add(1)
+	st.lastActivity.Store(time.Now().UnixMilli())
+}
+
+func (st *sessionStats) toJS(i *jsIPN) map[string]any {
+	now := time.Now()
+	lastActivity := st.lastActivity.Load()
+	st.mu.Lock()
+	peer := st.peer
+	st.mu.Unlock()
+
+	return map[string]any{
+		"bytesSent":        st.bytesSent.Load(),
+		"bytesReceived":    st.bytesReceived.Load(),
+		"messagesSent":     st.messagesSent.Load(),
+		"messagesReceived": st.messagesReceived.Load(),
+		"ageMs":            now.Sub(st.createdAt).Milliseconds(),
+		"lastActivity":     lastActivity,
+		"idleMs":           now.UnixMilli() - lastActivity,
+		"path":             i.peerPath(peer),
+		"time":             now.UnixMilli(),
+	}
+}
+
+// peerPath reports whether traffic to the peer owning addr goes direct or is
+// relayed through DERP.
+func (i *jsIPN) peerPath(addr netip.Addr) map[string]any {
+	path := map[string]any{"type": "unknown"}
+	if !addr.IsValid() {
+		return path
+	}
+
+	nm := i.lb.NetMap()
+	if nm == nil {
+		return path
+	}
+	peer, ok := nm.PeerByTailscaleIP(addr)
+	if !ok {
+		return path
+	}
+	path["peer"] = peer.Hostinfo().Hostname()
+	ps, ok := i.magicsockPeers(peerPathMaxAge)[peer.Key()]
+	switch {
+	case !ok:
+	case ps.CurAddr != "":
+		path["type"] = "direct"
+		path["endpoint"] = ps.CurAddr
+	case ps.Relay != "":
+		path["type"] = "derp"
+		path["derpRegion"] = ps.Relay
+	}
+	return path
+}
+
+// statsCallbackOption reads the onStats callback and its statsIntervalMs from
+// a session config.
+func statsCallbackOption(config js.Value) (js.Value, time.Duration) {
+	interval := defaultStatsInterval
+	if jsInterval := config.Get("statsIntervalMs"); jsInterval.Type() == js.TypeNumber && jsInterval.Int() > 0 {
+		interval = time.Duration(jsInterval.Int()) * time.Millisecond
+	}
+	return config.Get("onStats"), interval
+}
+
+// reportStats invokes callback with the current stats every interval until
+// done is closed.
+func reportStats(done <-chan struct{}, interval time.Duration, callback js.Value, stats func() map[string]any) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			callback.Invoke(stats())
+		}
+	}
+}
+
+func (i *jsIPN) ssh(host, username string, termConfig js.Value) map[string]any {
+	jsSSHSession := &jsSSHSession{
+		jsIPN:      i,
+		host:       host,
+		username:   username,
+		termConfig: termConfig,
+		stats:      newSessionStats(nil),
+	}
+
+	go jsSSHSession.Run()
+
+	return map[string]any{
+		/**
+		 * Traffic statistics and the path to the peer
+		 *
+		 * @returns IPNSessionStats
+		 */
+		"stats": js.FuncOf(func(this js.Value, args []js.Value) any {
+			return jsSSHSession.stats.toJS(i)
+		}),
+		"close": js.FuncOf(func(this js.Value, args []js.Value) any {
+			return jsSSHSession.Close() != nil
+		}),
+		"resize": js.FuncOf(func(this js.Value, args []js.Value) any {
+			rows := args[0].Int()
+			cols := args[1].Int()
+			return jsSSHSession.Resize(rows, cols) != nil
+		}),
+	}
+}
+
+type jsSSHSession struct {
+	jsIPN      *jsIPN
+	host       string
+	username   string
+	termConfig js.Value
+	session    *ssh.Session
+	stats      *sessionStats
+
+	pendingResizeRows int
+	pendingResizeCols int
+}
+
+func (s *jsSSHSession) Run() {
+	writeFn := s.termConfig.Get("writeFn")
+	writeErrorFn := s.termConfig.Get("writeErrorFn")
+	setReadFn := s.termConfig.Get("setReadFn")
+	rows := s.termConfig.Get("rows").Int()
+	cols := s.termConfig.Get("cols").Int()
+	timeoutSeconds := 5.0
+	if jsTimeoutSeconds := s.termConfig.Get("timeoutSeconds"); jsTimeoutSeconds.Type() == js.TypeNumber {
+		timeoutSeconds = jsTimeoutSeconds.Float()
+	}
+	onConnectionProgress := s.termConfig.Get("onConnectionProgress")
+	onConnected := s.termConfig.Get("onConnected")
+	onDone := s.termConfig.Get("onDone")
+	defer onDone.Invoke()
+
+	writeError := func(label string, err error) {
+		writeErrorFn.Invoke(fmt.Sprintf("%s Error: %v\r\n", label, err))
+	}
+	reportProgress := func(message string) {
+		onConnectionProgress.Invoke(message)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds*float64(time.Second)))
+	defer cancel()
+	reportProgress(fmt.Sprintf("Connecting to %s…", strings.Split(s.host, ".")[0]))
+	c, err := s.jsIPN.dialer.UserDial(ctx, "tcp", net.JoinHostPort(s.host, "22"))
+	if err != nil {
+		writeError("Dial", err)
+		return
+	}
+	defer c.Close()
+	s.stats.setPeer(c.RemoteAddr())
+	s.jsIPN.sessions.Store(s.stats, activeSession{"ssh", s.username + "@" + s.host, func() map[string]any {
+		return s.stats.toJS(s.jsIPN)
+	}})
+	defer s.jsIPN.sessions.Delete(s.stats)
+
+	config := &ssh.ClientConfig{
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			// Host keys are not used with Tailscale SSH, but we can use this
+			// callback to know that the connection has been established.
+			reportProgress("SSH connection established…")
+			return nil
+		},
+		User: s.username,
+	}
+
+	reportProgress("Starting SSH client…")
+	sshConn, _, _, err := ssh.NewClientConn(c, s.host, config)
+	if err != nil {
+		writeError("SSH Connection", err)
+		return
+	}
+	defer sshConn.Close()
+
+	sshClient := ssh.NewClient(sshConn, nil, nil)
+	defer sshClient.Close()
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		writeError("SSH Session", err)
+		return
+	}
+	s.session = session
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		writeError("SSH Stdin", err)
+		return
+	}
+
+	session.Stdout = termWriter{writeFn, s.stats}
+	session.Stderr = termWriter{writeFn, s.stats}
+
+	setReadFn.Invoke(js.FuncOf(func(this js.Value, args []js.Value) any {
+		input := args[0].String()
+		n, err := stdin.Write([]byte(input))
+		if err != nil {
+			writeError("Write Input", err)
+		}
+		s.stats.sent(n)
+		return nil
+	}))
+
+	if onStats, interval := statsCallbackOption(s.termConfig); onStats.Type() == js.TypeFunction {
+		done := make(chan struct{})
+		defer close(done)
+		go reportStats(done, interval, onStats, func() map[string]any {
+			return s.stats.toJS(s.jsIPN)
+		})
+	}
+
+	// We might have gotten a resize notification since we started opening the
+	// session, pick up the latest size.
+	if s.pendingResizeRows != 0 {
+		rows = s.pendingResizeRows
+	}
+	if s.pendingResizeCols != 0 {
+		cols = s.pendingResizeCols
+	}
+	err = session.RequestPty("xterm", rows, cols, ssh.TerminalModes{})
+
+	if err != nil {
+		writeError("Pseudo Terminal", err)
+		return
+	}
+
+	err = session.Shell()
+	if err != nil {
+		writeError("Shell", err)
+		return
+	}
+
+	onConnected.Invoke()
+	err = session.Wait()
+	if err != nil {
+		writeError("Wait", err)
+		return
+	}
+}
+
+func (s *jsSSHSession) Close() error {
+	if s.session == nil {
+		// We never had a chance to open the session, ignore the close request.
+		return nil
+	}
+	return s.session.Close()
+}
+
+func (s *jsSSHSession) Resize(rows, cols int) error {
+	if s.session == nil {
+		s.pendingResizeRows = rows
+		s.pendingResizeCols = cols
+		return nil
+	}
+	return s.session.WindowChange(rows, cols)
+}
+
+func (i *jsIPN) fetch(opt js.Value) js.Value {
+	return makePromise(func() (any, error) {
+		reqUrl := opt.Get("url")
+		if reqUrl.Type() != js.TypeString {
+			return nil, jsErrorf(errCodeInvalidArgument, "Request url is missing")
+		}
+		parsedUrl, err := url.Parse(reqUrl.String())
+		if err != nil {
+			return nil, jsErrorf(errCodeInvalidArgument, "Invalid request url: %v", err)
+		}
+		if err := i.checkRunning(); err != nil {
+			return nil, err
+		}
+
+		rawMethod := opt.Get("method")
+		var method string
+		if rawMethod.Type() == js.TypeString {
+			method = rawMethod.String()
+		} else {
+			method = "GET"
+		}
+
+		rawHeaders := opt.Get("headers")
+		var headers map[string][]string
+		if rawHeaders.Type() == js.TypeObject {
+			headers = copyObjectToGo(rawHeaders)
+		}
+
+		rawBody := opt.Get("body")
+
+		c := &http.Client{
+			Transport: &http.Transport{
+				DialContext: i.dialer.UserDial,
+			},
+		}
+
+		var res *http.Response
+
+		if method == "POST" && rawBody.Type() == js.TypeString {
+			res, err = c.Do(&http.Request{
+				URL:    parsedUrl,
+				Method: method,
+				Header: headers,
+				Body:   io.NopCloser(strings.NewReader(rawBody.String())),
+			})
+		} else {
+			res, err = c.Do(&http.Request{
+				URL:    parsedUrl,
+				Method: method,
+				Header: headers,
+			})
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]any{
+			"status":     res.StatusCode,
+			"statusText": res.Status,
+			"text": js.FuncOf(func(this js.Value, args []js.Value) any {
+				return makePromise(func() (any, error) {
+					defer res.Body.Close()
+					buf := new(bytes.Buffer)
+					if _, err := buf.ReadFrom(res.Body); err != nil {
+						return nil, err
+					}
+					return buf.String(), nil
+				})
+			}),
+			// TODO: populate a more complete JS Response object
+		}, nil
+	})
+}
+
+const (
+	taildropChunkSize        = 64 << 10
+	taildropProgressInterval = 100 * time.Millisecond
+)
+
+// taildropTargets returns the peers files can be sent to.
+func (i *jsIPN) taildropTargets() map[tailcfg.NodeID]bool {
+	targets := map[tailcfg.NodeID]bool{}
+	// Fails while not Running or without the file sharing capability, no
+	// peer is a target then.
+	fileTargets, _ := i.lb.FileTargets()
+	for _, t := range fileTargets {
+		targets[t.Node.ID] = true
+	}
+	return targets
+}
+
+// notifyIncomingFiles reports incoming and waiting files to the
+// notifyIncomingFiles callback, if there is one.
+func (i *jsIPN) notifyIncomingFiles(incoming []ipn.PartialFile) {
+	if i.callbacks.Type() != js.TypeObject || i.callbacks.Get("notifyIncomingFiles").Type() != js.TypeFunction {
+		return
+	}
+	i.callbacks.Call("notifyIncomingFiles", i.jsIncomingFiles(incoming))
+}
+
+// jsIncomingFiles returns the files being received and the received files
+// waiting to be read with openFile.
+func (i *jsIPN) jsIncomingFiles(incoming []ipn.PartialFile) map[string]any {
+	waiting, err := i.lb.WaitingFiles()
+	if err != nil {
+		logs.errorf("Could not list waiting files: %v", err)
+	}
+	return map[string]any{
+		"incoming": mapSlice(incoming, func(f ipn.PartialFile) any {
+			return map[string]any{
+				"name":         f.Name,
+				"started":      f.Started.UnixMilli(),
+				"declaredSize": f.DeclaredSize,
+				"received":     f.Received,
+			}
+		}),
+		"waiting": mapSlice(waiting, jsWaitingFile),
+	}
+}
+
+func jsWaitingFile(f apitype.WaitingFile) any {
+	return map[string]any{
+		"name": f.Name,
+		"size": f.Size,
+	}
+}
+
+// sendFile sends data, a Uint8Array or ReadableStream, to the peer with
+// Taildrop. It resolves with the number of bytes sent.
+func (i *jsIPN) sendFile(peerID, name string, data, options js.Value) js.Value {
+	return makePromise(func() (any, error) {
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			return nil, jsErrorf(errCodeInvalidArgument, "Invalid file name %q", name)
+		}
+
+		var body io.Reader
+		size := int64(-1)
+		switch {
+		case data.InstanceOf(js.Global().Get("Uint8Array")):
+			b := make([]byte, data.Length())
+			js.CopyBytesToGo(b, data)
+			body = bytes.NewReader(b)
+			size = int64(len(b))
+		case data.InstanceOf(js.Global().Get("ReadableStream")):
+			reader := &jsStreamReader{reader: data.Call("getReader")}
+			defer reader.close()
+			body = reader
+			if jsSize := options.Get("size"); jsSize.Type() == js.TypeNumber {
+				size = int64(jsSize.Int())
+			}
+		default:
+			return nil, jsErrorf(errCodeInvalidArgument, "data must be a Uint8Array or ReadableStream")
+		}
+
+		if err := i.checkRunning(); err != nil {
+			return nil, err
+		}
+		fileTargets, err := i.lb.FileTargets()
+		if err != nil {
+			return nil, jsErrorf(errCodeNotSupported, "%v", err)
+		}
+		idx := slices.IndexFunc(fileTargets, func(t *apitype.FileTarget) bool {
+			return strconv.FormatInt(int64(t.Node.ID), 10) == peerID || string(t.Node.StableID) == peerID
+		})
+		if idx < 0 {
+			return nil, jsErrorf(errCodeInvalidArgument, "Peer %s can not receive files", peerID)
+		}
+
+		progress := &progressReader{r: body, total: size}
+		if onProgress := options.Get("onProgress"); onProgress.Type() == js.TypeFunction {
+			progress.onProgress = func(sent, total int64) {
+				onProgress.Invoke(sent, total)
+			}
+		}
+
+		req, err := http.NewRequest(http.MethodPut, fileTargets[idx].PeerAPIURL+"/v0/put/"+url.PathEscape(name), progress)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+
+		client := &http.Client{Transport: i.dialer.PeerAPITransport()}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+			code := errCodeIO
+			if res.StatusCode == http.StatusForbidden {
+				code = errCodeACLDenied
+			}
+			return nil, jsErrorf(code, "Sending file failed: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+		}
+		progress.report(true)
+		return progress.sent, nil
+	})
+}
+
+// progressReader reports how much of r was read, at most every
+// taildropProgressInterval.
+type progressReader struct {
+	r          io.Reader
+	sent       int64
+	total      int64
+	lastReport time.Time
+	onProgress func(sent, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.sent += int64(n)
+	p.report(false)
+	return n, err
+}
+
+func (p *progressReader) report(final bool) {
+	if p.onProgress == nil || (!final && time.Since(p.lastReport) < taildropProgressInterval) {
+		return
+	}
+	p.lastReport = time.Now()
+	p.onProgress(p.sent, p.total)
+}
+
+// jsStreamReader reads a JS ReadableStream.
+type jsStreamReader struct {
+	reader  js.Value
+	pending []byte
+	done    bool
+}
+
+func (r *jsStreamReader) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		res, err := awaitPromise(r.reader.Call("read"))
+		if err != nil {
+			return 0, err
+		}
+		if res.Get("done").Bool() {
+			r.done = true
+			continue
+		}
+		chunk := res.Get("value")
+		r.pending = make([]byte, chunk.Length())
+		js.CopyBytesToGo(r.pending, chunk)
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *jsStreamReader) close() {
+	if !r.done {
+		r.reader.Call("cancel")
+	}
+	r.reader.Call("releaseLock")
+}
+
+// waitingFiles lists the received files.
+func (i *jsIPN) waitingFiles() (any, error) {
+	waiting, err := i.lb.WaitingFiles()
+	if err != nil {
+		return nil, err
+	}
+	return mapSlice(waiting, jsWaitingFile), nil
+}
+
+// openFile returns a received file as a ReadableStream of Uint8Array chunks.
+func (i *jsIPN) openFile(name string) (any, error) {
+	rc, size, err := i.lb.OpenFile(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, jsErrorf(errCodeInvalidArgument, "No waiting file %q", name)
+		}
+		return nil, err
+	}
+
+	var pull, cancel js.Func
+	closeFile := func() {
+		rc.Close()
+		pull.Release()
+		cancel.Release()
+	}
+	buf := make([]byte, taildropChunkSize)
+	pull = js.FuncOf(func(this js.Value, args []js.Value) any {
+		controller := args[0]
+		return makePromise(func() (any, error) {
+			// The stream only pulls again after something was enqueued.
+			for {
+				n, err := rc.Read(buf)
+				if n > 0 {
+					chunk := js.Global().Get("Uint8Array").New(n)
+					js.CopyBytesToJS(chunk, buf[:n])
+					controller.Call("enqueue", chunk)
+				}
+				if err == io.EOF {
+					controller.Call("close")
+					closeFile()
+					return nil, nil
+				}
+				if err != nil {
+					closeFile()
+					return nil, err
+				}
+				if n > 0 {
+					return nil, nil
+				}
+			}
+		})
+	})
+	cancel = js.FuncOf(func(this js.Value, args []js.Value) any {
+		closeFile()
+		return nil
+	})
+
+	return map[string]any{
+		"name": name,
+		"size": size,
+		"stream": js.Global().Get("ReadableStream").New(map[string]any{
+			"pull":   pull,
+			"cancel": cancel,
+		}),
+	}, nil
+}
+
+const resolveTimeout = 10 * time.Second
+
+var dnsRecordTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+	"PTR":   dnsmessage.TypePTR,
+}
+
+// resolve queries name through the Tailscale resolver, which applies MagicDNS
+// and the split DNS routes of the netmap. Names without dots are tried with
+// the MagicDNS suffix and search domains first. For PTR queries name may be
+// an IP, tailnet IPs are answered from the netmap.
+func (i *jsIPN) resolve(name, recordType string) (any, error) {
+	qtype, ok := dnsRecordTypes[strings.ToUpper(recordType)]
+	if !ok {
+		return nil, jsErrorf(errCodeInvalidArgument, "Record type must be one of A, AAAA, CNAME, SRV, TXT or PTR")
+	}
+	if name == "" {
+		return nil, jsErrorf(errCodeInvalidArgument, "Name must not be empty")
+	}
+	nm := i.lb.NetMap()
+
+	var candidates []string
+	if addr, err := netip.ParseAddr(name); err == nil {
+		if qtype != dnsmessage.TypePTR {
+			return nil, jsErrorf(errCodeInvalidArgument, "IPs can only be resolved with PTR")
+		}
+		if nodeName, ok := netMapNodeName(nm, addr); ok {
+			return map[string]any{
+				"name":      name,
+				"type":      "PTR",
+				"rcode":     "NOERROR",
+				"source":    "netmap",
+				"answers":   []any{map[string]any{"name": name, "type": "PTR", "ttl": 0, "data": nodeName}},
+				"resolvers": []any{},
+			}, nil
+		}
+		candidates = []string{reverseName(addr)}
+	} else {
+		candidates = resolveCandidates(nm, name)
+	}
+
+	type result struct {
+		res any
+		err error
+	}
+	c := make(chan result, 1)
+	go func() {
+		var res map[string]any
+		var err error
+		for _, candidate := range candidates {
+			res, err = i.queryDNS(candidate, qtype)
+			if err != nil || res["rcode"] != "NXDOMAIN" {
+				break
+			}
+		}
+		c <- result{res, err}
+	}()
+	select {
+	case r := <-c:
+		return r.res, r.err
+	case <-time.After(resolveTimeout):
+		return nil, jsErrorf(errCodeTimedOut, "Resolving %s timed out", name)
+	}
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of addr.
+func reverseName(addr netip.Addr) string {
+	var labels []string
+	if addr.Is4() || addr.Is4In6() {
+		for _, b := range addr.Unmap().As4() {
+			labels = append(labels, strconv.Itoa(int(b)))
+		}
+		slices.Reverse(labels)
+		return strings.Join(labels, ".") + ".in-addr.arpa"
+	}
+	for _, b := range addr.As16() {
+		labels = append(labels, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+	}
+	slices.Reverse(labels)
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
+
+// resolveCandidates returns the names to try for name, in order.
+func resolveCandidates(nm *netmap.NetworkMap, name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if strings.Contains(name, ".") || nm == nil {
+		return []string{name}
+	}
+	var candidates []string
+	if suffix := nm.MagicDNSSuffix(); suffix != "" {
+		candidates = append(candidates, name+"."+suffix)
+	}
+	for _, domain := range nm.DNS.Domains {
+		candidates = append(candidates, name+"."+strings.TrimSuffix(domain, "."))
+	}
+	return append(candidates, name)
+}
+
+// netMapNodeName returns the MagicDNS name of the node with address addr.
+func netMapNodeName(nm *netmap.NetworkMap, addr netip.Addr) (string, bool) {
+	if nm == nil {
+		return "", false
+	}
+	if slices.ContainsFunc(nm.GetAddresses().AsSlice(), func(p netip.Prefix) bool { return p.Addr() == addr }) {
+		return nm.Name, true
+	}
+	if p, ok := nm.PeerByTailscaleIP(addr); ok && p.Name() != "" {
+		return p.Name(), true
+	}
+	return "", false
+}
+
+func (i *jsIPN) queryDNS(name string, qtype dnsmessage.Type) (map[string]any, error) {
+	res, resolvers, err := i.lb.QueryDNS(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(res)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse DNS response: %w", err)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, fmt.Errorf("Could not parse DNS response: %w", err)
+	}
+	answers := []any{}
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse DNS response: %w", err)
+		}
+		data, err := dnsAnswerData(&p, h.Type)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse DNS response: %w", err)
+		}
+		answers = append(answers, map[string]any{
+			"name": h.Name.String(),
+			"type": strings.TrimPrefix(h.Type.String(), "Type"),
+			"ttl":  h.TTL,
+			"data": data,
+		})
+	}
+
+	return map[string]any{
+		"name":      name,
+		"type":      strings.TrimPrefix(qtype.String(), "Type"),
+		"rcode":     dnsRCode(header.RCode),
+		"source":    "dns",
+		"answers":   answers,
+		"resolvers": mapSlice(resolvers, func(r *dnstype.Resolver) any { return r.Addr }),
+	}, nil
+}
+
+func dnsRCode(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	default:
+		return strconv.Itoa(int(rcode))
+	}
+}
+
+// dnsAnswerData parses the body of an answer. Unsupported types are skipped
+// and have null data.
+func dnsAnswerData(p *dnsmessage.Parser, t dnsmessage.Type) (any, error) {
+	switch t {
+	case dnsmessage.TypeA:
+		r, err := p.AResource()
+		return netip.AddrFrom4(r.A).String(), err
+	case dnsmessage.TypeAAAA:
+		r, err := p.AAAAResource()
+		return netip.AddrFrom16(r.AAAA).String(), err
+	case dnsmessage.TypeCNAME:
+		r, err := p.CNAMEResource()
+		return r.CNAME.String(), err
+	case dnsmessage.TypePTR:
+		r, err := p.PTRResource()
+		return r.PTR.String(), err
+	case dnsmessage.TypeSRV:
+		r, err := p.SRVResource()
+		return map[string]any{
+			"priority": r.Priority,
+			"weight":   r.Weight,
+			"port":     r.Port,
+			"target":   r.Target.String(),
+		}, err
+	case dnsmessage.TypeTXT:
+		r, err := p.TXTResource()
+		return mapSlice(r.TXT, func(s string) any { return s }), err
+	default:
+		return nil, p.SkipAnswer()
+	}
+}
+
+// jsConnectionPreset mirrors the presets served by `headscale-console serve`
+// at /connections.json.
+type jsConnectionPreset struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Peer     string `json:"peer,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	Scheme   string `json:"scheme,omitempty"`
+	Path     string `json:"path,omitempty"`
+}
+
+type jsResolvedConnection struct {
+	jsConnectionPreset
+	Targets   []jsConnectionTarget `json:"targets"`
+	Reachable bool                 `json:"reachable"`
+}
+
+type jsConnectionTarget struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Online  bool   `json:"online"`
+}
+
+var defaultConnectionPorts = map[string]int{
+	"ssh":  22,
+	"vnc":  5900,
+	"rdp":  3389,
+	"http": 80,
+}
+
+// resolveConnections matches connection presets against the current netmap
+// and returns them as JSON, with default ports filled in and the peers each
+// preset targets. A preset is reachable if any of its peers is online.
+func (i *jsIPN) resolveConnections(connectionsJSON string) (any, error) {
+	var file struct {
+		Connections []jsConnectionPreset `json:"connections"`
+	}
+	if err := json.Unmarshal([]byte(connectionsJSON), &file); err != nil {
+		return nil, jsErrorf(errCodeInvalidArgument, "Could not parse connections: %v", err)
+	}
+
+	var peers []tailcfg.NodeView
+	if nm := i.lb.NetMap(); nm != nil {
+		peers = nm.Peers
+	}
+
+	resolved := mapSlice(file.Connections, func(c jsConnectionPreset) jsResolvedConnection {
+		if c.Port == 0 {
+			c.Port = defaultConnectionPorts[c.Protocol]
+			if c.Protocol == "http" && c.Scheme == "https" {
+				c.Port = 443
+			}
+		}
+		r := jsResolvedConnection{jsConnectionPreset: c, Targets: []jsConnectionTarget{}}
+		for _, p := range peers {
+			if !connectionMatchesPeer(c, p) {
+				continue
+			}
+			target := jsConnectionTarget{
+				ID:     strconv.FormatInt(int64(p.ID()), 10),
+				Name:   p.Name(),
+				Online: p.Online().Get() && !p.Expired(),
+			}
+			if p.Addresses().Len() > 0 {
+				target.Address = p.Addresses().At(0).Addr().String()
+			}
+			r.Targets = append(r.Targets, target)
+			r.Reachable = r.Reachable || target.Online
+		}
+		return r
+	})
+
+	jsonResolved, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate JSON connections: %w", err)
+	}
+	return string(jsonResolved), nil
+}
+
+// connectionMatchesPeer matches by tag or, case-insensitively, by MagicDNS
+// name (full or short) or hostname.
+func connectionMatchesPeer(c jsConnectionPreset, p tailcfg.NodeView) bool {
+	if c.Tag != "" {
+		return views.SliceContains(p.Tags(), c.Tag)
+	}
+	name := strings.TrimSuffix(p.Name(), ".")
+	shortName, _, _ := strings.Cut(name, ".")
+	for _, candidate := range []string{name, shortName, p.Hostinfo().Hostname()} {
+		if candidate != "" && strings.EqualFold(candidate, strings.TrimSuffix(c.Peer, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+type termWriter struct {
+	f     js.Value
+	stats *sessionStats
+}
+
+func (w termWriter) Write(p []byte) (n int, err error) {
+	r := bytes.Replace(p, []byte("\n"), []byte("\n\r"), -1)
+	w.f.Invoke(string(r))
+	w.stats.received(len(p))
+	return len(p), nil
+}
+
+// peerPathMaxAge is how long the stats of all sessions share one read of the
+// peer paths.
+const peerPathMaxAge = time.Second
+
+// peerPathCache holds the last magicsockPeers result.
+type peerPathCache struct {
+	mu    sync.Mutex
+	at    time.Time
+	peers map[key.NodePublic]*ipnstate.PeerStatus
+}
+
+// magicsockPeers returns the current path of every peer, or the last one read
+// if it isn't older than maxAge. Unlike lb.Status it neither takes the backend
+// lock nor queries WireGuard.
+func (i *jsIPN) magicsockPeers(maxAge time.Duration) map[key.NodePublic]*ipnstate.PeerStatus {
+	c := &i.peerPaths
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peers != nil && time.Since(c.at) <= maxAge {
+		return c.peers
+	}
+	sb := &ipnstate.StatusBuilder{WantPeers: true}
+	i.lb.MagicConn().UpdateStatus(sb)
+	c.peers, c.at = sb.Status().Peer, time.Now()
+	if c.peers == nil {
+		c.peers = map[key.NodePublic]*ipnstate.PeerStatus{}
+	}
+	return c.peers
+}
+
+// jsNetMap converts nm for notifyNetMap and getNetMap.
+func (i *jsIPN) jsNetMap(nm *netmap.NetworkMap) *jsNetMap {
+	taildropTargets := i.taildropTargets()
+	peerStatus := i.magicsockPeers(0)
+	var self jsUserProfile
+	if u, ok := nm.UserProfiles[nm.User()]; ok {
+		self = jsUserProfile{
+			LoginName:     u.LoginName(),
+			DisplayName:   u.DisplayName(),
+			ProfilePicURL: u.ProfilePicURL(),
+		}
+	}
+	return &jsNetMap{
+		Self: jsNetMapSelfNode{
+			jsNetMapNode: jsNetMapNode{
+				Name:       nm.Name,
+				Addresses:  mapSliceView(nm.GetAddresses(), func(a netip.Prefix) string { return a.Addr().String() }),
+				NodeKey:    nm.NodeKey.String(),
+				MachineKey: nm.MachineKey.String(),
+				CreatedAt:  nm.SelfNode.Created().String(),
+				IPNVersion: nm.SelfNode.Hostinfo().IPNVersion(),
+				StableID:   string(nm.SelfNode.StableID()),
+				Hostname:   nm.SelfNode.Hostinfo().Hostname(),
+				KeyExpiry:  jsTime(nm.SelfNode.KeyExpiry()),
+				HomeDERP:   nm.SelfNode.HomeDERP(),
+			},
+			Tags:          nm.SelfNode.Tags(),
+			MachineStatus: jsMachineStatus[nm.GetMachineStatus()],
+			User:          self,
+			DNS:           jsDNS(nm.DNS),
+		},
+		Users: nm.UserProfiles,
+		Peers: mapSlice(nm.Peers, func(p tailcfg.NodeView) jsNetMapPeerNode {
+			name := p.Name()
+			if name == "" {
+				// In practice this should only happen for Hello.
+				name = p.Hostinfo().Hostname()
+			}
+			addrs := make([]string, p.Addresses().Len())
+			for i, ap := range p.Addresses().All() {
+				addrs[i] = ap.Addr().String()
+			}
+			var curAddr string
+			if ps, ok := peerStatus[p.Key()]; ok {
+				curAddr = ps.CurAddr
+			}
+			return jsNetMapPeerNode{
+				jsNetMapNode: jsNetMapNode{
+					Name:       name,
+					Addresses:  addrs,
+					MachineKey: p.Machine().String(),
+					NodeKey:    p.Key().String(),
+					CreatedAt:  p.Created().String(),
+					IPNVersion: p.Hostinfo().IPNVersion(),
+					StableID:   string(p.StableID()),
+					Hostname:   p.Hostinfo().Hostname(),
+					KeyExpiry:  jsTime(p.KeyExpiry()),
+					HomeDERP:   p.HomeDERP(),
+				},
+				LastSeen:            p.LastSeen().String(),
+				OS:                  p.Hostinfo().OS(),
+				OSVersion:           p.Hostinfo().OSVersion(),
+				User:                p.User().String(),
+				Tags:                p.Tags(),
+				Routes:              p.Hostinfo().RoutableIPs(),
+				Online:              *p.Online().Clone(),
+				Expired:             p.Expired(),
+				TailscaleSSHEnabled: p.Hostinfo().TailscaleSSHEnabled(),
+				ID:                  strconv.FormatInt(int64(p.ID()), 10),
+				CapMap:              p.CapMap().AsMap(),
+				ExitNode:            tsaddr.ContainsExitRoutes(p.AllowedIPs()),
+				TaildropTarget:      taildropTargets[p.ID()],
+				SubnetRouter: slices.ContainsFunc(p.PrimaryRoutes().AsSlice(), func(r netip.Prefix) bool {
+					return !tsaddr.IsExitRoute(r)
+				}),
+				PrimaryRoutes: p.PrimaryRoutes(),
+				Endpoints:     mapSliceView(p.Endpoints(), netip.AddrPort.String),
+				CurAddr:       curAddr,
+				Direct:        curAddr != "",
+				Services: mapSliceView(p.Hostinfo().Services(), func(s tailcfg.Service) jsService {
+					return jsService{
+						Proto:       string(s.Proto),
+						Port:        s.Port,
+						Description: s.Description,
+					}
+				}),
+			}
+		}),
+		LockedOut: nm.TKAEnabled && nm.SelfNode.KeySignature().Len() == 0,
+		Domain:    nm.MagicDNSSuffix(),
+	}
+}
+
+// jsTime formats t as RFC 3339, or returns "" for the zero time.
+func jsTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
 	}
-	s.session = session
-	defer session.Close()
+	return t.UTC().Format(time.RFC3339)
+}
 
-	stdin, err := session.StdinPipe()
-	if err != nil {
-		writeError("SSH Stdin", err)
-		return
+func jsDNS(dns tailcfg.DNSConfig) jsDNSConfig {
+	resolverAddrs := func(resolvers []*dnstype.Resolver) []string {
+		return mapSlice(resolvers, func(r *dnstype.Resolver) string { return r.Addr })
+	}
+	routes := make(map[string][]string, len(dns.Routes))
+	for suffix, resolvers := range dns.Routes {
+		routes[suffix] = resolverAddrs(resolvers)
 	}
+	return jsDNSConfig{
+		MagicDNS:  dns.Proxied,
+		Resolvers: resolverAddrs(dns.Resolvers),
+		Domains:   append([]string{}, dns.Domains...),
+		Routes:    routes,
+	}
+}
 
-	session.Stdout = termWriter{writeFn}
-	session.Stderr = termWriter{writeFn}
+const defaultNetMapThrottle = 250 * time.Millisecond
 
-	setReadFn.Invoke(js.FuncOf(func(this js.Value, args []js.Value) any {
-		input := args[0].String()
-		_, err := stdin.Write([]byte(input))
-		if err != nil {
-			writeError("Write Input", err)
-		}
-		return nil
-	}))
+// netMapNotifier passes netmaps to JS, at most one per throttle interval.
+// Netmaps arriving in between are coalesced into one trailing notification.
+// With deltas set, only the first netmap and netmaps with changes outside of
+// the peers are passed to notifyNetMap, peer changes go to
+// notifyPeersChanged.
+type netMapNotifier struct {
+	jsIPN       *jsIPN
+	jsCallbacks js.Value
+	throttle    time.Duration
+	deltas      bool
+	recover     func()
 
-	// We might have gotten a resize notification since we started opening the
-	// session, pick up the latest size.
-	if s.pendingResizeRows != 0 {
-		rows = s.pendingResizeRows
-	}
-	if s.pendingResizeCols != 0 {
-		cols = s.pendingResizeCols
-	}
-	err = session.RequestPty("xterm", rows, cols, ssh.TerminalModes{})
+	mu       sync.Mutex
+	pending  *netmap.NetworkMap
+	last     *netmap.NetworkMap
+	timer    *time.Timer
+	lastSent time.Time
 
-	if err != nil {
-		writeError("Pseudo Terminal", err)
-		return
-	}
+	// emitMu serializes emit and guards the last emitted snapshot.
+	emitMu sync.Mutex
+	full   []byte
+	peers  map[string][]byte
+	rest   []byte
+}
 
-	err = session.Shell()
-	if err != nil {
-		writeError("Shell", err)
+func (n *netMapNotifier) update(nm *netmap.NetworkMap) {
+	n.mu.Lock()
+	n.pending, n.last = nm, nm
+	if n.timer != nil {
+		n.mu.Unlock()
 		return
 	}
-
-	onConnected.Invoke()
-	err = session.Wait()
-	if err != nil {
-		writeError("Wait", err)
+	if wait := n.throttle - time.Since(n.lastSent); wait > 0 {
+		n.timer = time.AfterFunc(wait, n.flush)
+		n.mu.Unlock()
 		return
 	}
+	n.mu.Unlock()
+	n.flush()
 }
 
-func (s *jsSSHSession) Close() error {
-	if s.session == nil {
-		// We never had a chance to open the session, ignore the close request.
-		return nil
+// refresh passes the last netmap again. The current address of peers comes
+// from magicsock and changes without a new netmap, so this is called on
+// engine status updates.
+func (n *netMapNotifier) refresh() {
+	n.mu.Lock()
+	nm := n.last
+	n.mu.Unlock()
+	if nm != nil {
+		n.update(nm)
 	}
-	return s.session.Close()
 }
 
-func (s *jsSSHSession) Resize(rows, cols int) error {
-	if s.session == nil {
-		s.pendingResizeRows = rows
-		s.pendingResizeCols = cols
-		return nil
+func (n *netMapNotifier) flush() {
+	n.mu.Lock()
+	nm := n.pending
+	n.pending, n.timer, n.lastSent = nil, nil, time.Now()
+	n.mu.Unlock()
+	if nm != nil {
+		defer n.recover()
+		n.emit(n.jsIPN.jsNetMap(nm))
 	}
-	return s.session.WindowChange(rows, cols)
 }
 
-func (i *jsIPN) fetch(opt js.Value) js.Value {
-	return makePromise(func() (any, error) {
-		reqUrl := opt.Get("url")
-		if reqUrl.Type() != js.TypeString {
-			return nil, errors.New("Request url is missing")
-		}
-		parsedUrl, err := url.Parse(reqUrl.String())
-		if err != nil {
-			return nil, err
-		}
+func (n *netMapNotifier) emit(jsNetMap *jsNetMap) {
+	n.emitMu.Lock()
+	defer n.emitMu.Unlock()
 
-		rawMethod := opt.Get("method")
-		var method string
-		if rawMethod.Type() == js.TypeString {
-			method = rawMethod.String()
-		} else {
-			method = "GET"
+	if !n.deltas {
+		full, err := json.Marshal(jsNetMap)
+		if err != nil {
+			logs.errorf("Could not generate JSON netmap: %v", err)
+			return
 		}
-
-		rawHeaders := opt.Get("headers")
-		var headers map[string][]string
-		if rawHeaders.Type() == js.TypeObject {
-			headers = copyObjectToGo(rawHeaders)
+		if !bytes.Equal(full, n.full) {
+			n.full = full
+			n.jsCallbacks.Call("notifyNetMap", string(full))
 		}
+		return
+	}
 
-		rawBody := opt.Get("body")
-
-		c := &http.Client{
-			Transport: &http.Transport{
-				DialContext: i.dialer.UserDial,
-			},
+	peers := make(map[string][]byte, len(jsNetMap.Peers))
+	for _, p := range jsNetMap.Peers {
+		b, err := json.Marshal(p)
+		if err != nil {
+			logs.errorf("Could not generate JSON peer: %v", err)
+			return
 		}
+		peers[p.ID] = b
+	}
+	rest := *jsNetMap
+	rest.Peers = nil
+	restJSON, err := json.Marshal(rest)
+	if err != nil {
+		logs.errorf("Could not generate JSON netmap: %v", err)
+		return
+	}
 
-		var res *http.Response
+	if n.peers == nil || !bytes.Equal(restJSON, n.rest) {
+		n.peers, n.rest = peers, restJSON
+		n.notifyNetMap(jsNetMap)
+		return
+	}
 
-		if method == "POST" && rawBody.Type() == js.TypeString {
-			res, err = c.Do(&http.Request{
-				URL:    parsedUrl,
-				Method: method,
-				Header: headers,
-				Body:   io.NopCloser(strings.NewReader(rawBody.String())),
-			})
-		} else {
-			res, err = c.Do(&http.Request{
-				URL:    parsedUrl,
-				Method: method,
-				Header: headers,
-			})
+	delta := jsPeersDelta{
+		Added:   []json.RawMessage{},
+		Removed: []string{},
+		Changed: []map[string]json.RawMessage{},
+	}
+	for _, p := range jsNetMap.Peers {
+		prev, ok := n.peers[p.ID]
+		switch {
+		case !ok:
+			delta.Added = append(delta.Added, peers[p.ID])
+		case !bytes.Equal(prev, peers[p.ID]):
+			changed, err := changedFields(prev, peers[p.ID])
+			if err != nil {
+				logs.errorf("Could not compare peer %s: %v", p.ID, err)
+				continue
+			}
+			delta.Changed = append(delta.Changed, changed)
 		}
-
-		if err != nil {
-			return nil, err
+	}
+	for id := range n.peers {
+		if _, ok := peers[id]; !ok {
+			delta.Removed = append(delta.Removed, id)
 		}
+	}
+	n.peers = peers
+	if len(delta.Added) == 0 && len(delta.Removed) == 0 && len(delta.Changed) == 0 {
+		return
+	}
 
-		return map[string]any{
-			"status":     res.StatusCode,
-			"statusText": res.Status,
-			"text": js.FuncOf(func(this js.Value, args []js.Value) any {
-				return makePromise(func() (any, error) {
-					defer res.Body.Close()
-					buf := new(bytes.Buffer)
-					if _, err := buf.ReadFrom(res.Body); err != nil {
-						return nil, err
-					}
-					return buf.String(), nil
-				})
-			}),
-			// TODO: populate a more complete JS Response object
-		}, nil
-	})
+	deltaJSON, err := json.Marshal(delta)
+	if err != nil {
+		logs.errorf("Could not generate JSON peers delta: %v", err)
+		return
+	}
+	n.jsCallbacks.Call("notifyPeersChanged", js.Global().Get("JSON").Call("parse", string(deltaJSON)))
 }
 
-var localClient local.Client
-
-func (i *jsIPN) resolve(hostname js.Value) js.Value {
-	return makePromise(func() (any, error) {
-		if hostname.Type() != js.TypeString {
-			return nil, errors.New("Hostname must be a string")
-		}
-
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		res, resolvers, err := localClient.QueryDNS(ctx, hostname.String(), "A")
-
-		if err != nil {
-			return nil, err
-		}
-
-		return map[string]any{
-			"result":    res,
-			"resolvers": resolvers,
-		}, nil
-	})
+func (n *netMapNotifier) notifyNetMap(jsNetMap *jsNetMap) {
+	if jsonNetMap, err := json.Marshal(jsNetMap); err == nil {
+		n.jsCallbacks.Call("notifyNetMap", string(jsonNetMap))
+	} else {
+		logs.errorf("Could not generate JSON netmap: %v", err)
+	}
 }
 
-type termWriter struct {
-	f js.Value
+type jsPeersDelta struct {
+	Added   []json.RawMessage `json:"added"`
+	Removed []string          `json:"removed"`
+	// Changed holds the id and the changed fields of each changed peer.
+	Changed []map[string]json.RawMessage `json:"changed"`
 }
 
-func (w termWriter) Write(p []byte) (n int, err error) {
-	r := bytes.Replace(p, []byte("\n"), []byte("\n\r"), -1)
-	w.f.Invoke(string(r))
-	return len(p), nil
+// changedFields returns the fields of the JSON object cur that differ from
+// prev, plus the id. Fields missing from cur are set to null, so that merging
+// the result into prev doesn't keep them.
+func changedFields(prev, cur []byte) (map[string]json.RawMessage, error) {
+	var prevFields, curFields map[string]json.RawMessage
+	if err := json.Unmarshal(prev, &prevFields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(cur, &curFields); err != nil {
+		return nil, err
+	}
+	changed := map[string]json.RawMessage{"id": curFields["id"]}
+	for k, v := range curFields {
+		if !bytes.Equal(v, prevFields[k]) {
+			changed[k] = v
+		}
+	}
+	for k := range prevFields {
+		if _, ok := curFields[k]; !ok {
+			changed[k] = json.RawMessage("null")
+		}
+	}
+	return changed, nil
 }
 
 type jsNetMap struct {
@@ -894,12 +3727,39 @@ type jsNetMapNode struct {
 	NodeKey    string   `json:"nodeKey"`
 	CreatedAt  string   `json:"createdAt"`
 	IPNVersion string   `json:"ipnVersion"`
+	StableID   string   `json:"stableID"`
+	// Hostname is the OS hostname, Name the MagicDNS name.
+	Hostname string `json:"hostname"`
+	// KeyExpiry is empty if the key does not expire.
+	KeyExpiry string `json:"keyExpiry"`
+	HomeDERP  int    `json:"homeDERP"`
 }
 
 type jsNetMapSelfNode struct {
 	jsNetMapNode
 	MachineStatus string              `json:"machineStatus"`
 	Tags          views.Slice[string] `json:"tags"`
+	User          jsUserProfile       `json:"user"`
+	DNS           jsDNSConfig         `json:"dns"`
+}
+
+type jsUserProfile struct {
+	LoginName     string `json:"loginName"`
+	DisplayName   string `json:"displayName"`
+	ProfilePicURL string `json:"profilePicURL"`
+}
+
+type jsDNSConfig struct {
+	MagicDNS  bool                `json:"magicDNS"`
+	Resolvers []string            `json:"resolvers"`
+	Domains   []string            `json:"domains"`
+	Routes    map[string][]string `json:"routes"`
+}
+
+type jsService struct {
+	Proto       string `json:"proto"`
+	Port        uint16 `json:"port"`
+	Description string `json:"description"`
 }
 
 type jsNetMapPeerNode struct {
@@ -915,6 +3775,18 @@ type jsNetMapPeerNode struct {
 	ID                  string                                          `json:"id"`
 	TailscaleSSHEnabled bool                                            `json:"tailscaleSSHEnabled"`
 	CapMap              map[tailcfg.NodeCapability][]tailcfg.RawMessage `json:"capMap"`
+	// ExitNode is set if the peer offers to be an exit node.
+	ExitNode bool `json:"exitNode"`
+	// TaildropTarget is set if files can be sent to the peer.
+	TaildropTarget bool `json:"taildropTarget"`
+	// SubnetRouter is set if the peer is the primary router of a subnet.
+	SubnetRouter  bool                      `json:"subnetRouter"`
+	PrimaryRoutes views.Slice[netip.Prefix] `json:"primaryRoutes"`
+	Endpoints     []string                  `json:"endpoints"`
+	// CurAddr is the endpoint of the direct path, empty if relayed.
+	CurAddr  string      `json:"curAddr"`
+	Direct   bool        `json:"direct"`
+	Services []jsService `json:"services"`
 }
 
 type jsStateStore struct {
@@ -950,6 +3822,15 @@ func mapSliceView[T any, M any](a views.Slice[T], f func(T) M) []M {
 	return n
 }
 
+// jsStringMap converts m for js.ValueOf, which only accepts map[string]any.
+func jsStringMap(m map[string]string) map[string]any {
+	n := make(map[string]any, len(m))
+	for k, v := range m {
+		n[k] = v
+	}
+	return n
+}
+
 func filterSlice[T any](a []T, f func(T) bool) []T {
 	n := make([]T, 0, len(a))
 	for _, e := range a {
@@ -978,6 +3859,103 @@ func generateHostname() string {
 	return fmt.Sprintf("%s-%s", tail, scale)
 }
 
+// Error codes set on the JS Error objects that functions of the bridge throw
+// or reject with. The same codes are reported by TCP sessions in onClose and
+// onError.
+const (
+	// errCodeInvalidArgument means the caller passed invalid arguments.
+	errCodeInvalidArgument = "EINVAL"
+	// errCodeTimedOut means the operation or connection timed out.
+	errCodeTimedOut = "ETIMEDOUT"
+	// errCodeNotRunning means the backend is not connected to the tailnet.
+	errCodeNotRunning = "ENOTRUNNING"
+	// errCodeACLDenied means the tailnet policy does not allow the
+	// connection.
+	errCodeACLDenied = "EACLDENIED"
+	// errCodeConnReset means the remote side reset the connection.
+	errCodeConnReset = "ECONNRESET"
+	// errCodeEOF means the remote side closed the connection.
+	errCodeEOF = "EOF"
+	// errCodeLocalClose means the session was closed by calling close().
+	errCodeLocalClose = "ELOCALCLOSE"
+	// errCodeClosed means the session was already closed.
+	errCodeClosed = "EPIPE"
+	// errCodeQueueFull means a write queue has no room left.
+	errCodeQueueFull = "ENOBUFS"
+	// errCodeHostUnreachable means there is no route to the destination,
+	// e.g. no exit node is selected.
+	errCodeHostUnreachable = "EHOSTUNREACH"
+	// errCodeNotSupported means the operation is not supported.
+	errCodeNotSupported = "ENOTSUP"
+	// errCodeIO is any other error.
+	errCodeIO = "EIO"
+)
+
+// jsError is an error with one of the errCode* codes.
+type jsError struct {
+	code    string
+	message string
+}
+
+func jsErrorf(code, format string, args ...any) *jsError {
+	return &jsError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func (e *jsError) Error() string {
+	return e.message
+}
+
+// errorCode returns the code of a jsError and guesses it for other errors.
+func errorCode(err error) string {
+	var jsErr *jsError
+	switch {
+	case errors.As(err, &jsErr):
+		return jsErr.code
+	case errors.Is(err, io.EOF):
+		return errCodeEOF
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		return errCodeTimedOut
+	case errors.Is(err, syscall.ECONNRESET) || strings.Contains(err.Error(), "connection reset"):
+		return errCodeConnReset
+	default:
+		return errCodeIO
+	}
+}
+
+// toJSError converts err to a JS Error with a code property.
+func toJSError(err error) js.Value {
+	jsErr := js.Global().Get("Error").New(err.Error())
+	jsErr.Set("code", errorCode(err))
+	return jsErr
+}
+
+// jsThrow wraps a Go function returning [result, error] in a JS function
+// throwing the error, Go functions can not throw JS exceptions themselves. It
+// is defined by createClient in index.ts, creating it here would need eval,
+// which a CSP without 'unsafe-eval' blocks.
+var jsThrow = sync.OnceValue(func() js.Value {
+	f := js.Global().Get("tsconnectThrow")
+	if f.Type() != js.TypeFunction {
+		panic("tsconnectThrow is not defined, load the module with createClient()")
+	}
+	return f
+})
+
+// jsFunc wraps f in a JS function that throws the errors f returns.
+func jsFunc(f func(args []js.Value) (any, error)) js.Value {
+	return jsThrow().Invoke(js.FuncOf(func(this js.Value, args []js.Value) any {
+		res, err := f(args)
+		if err != nil {
+			return []any{nil, toJSError(err)}
+		}
+		return []any{res, nil}
+	}))
+}
+
+func rejectedPromise(err error) js.Value {
+	return js.Global().Get("Promise").Call("reject", toJSError(err))
+}
+
 // makePromise handles the boilerplate of wrapping goroutines with JS promises.
 // f is run on a goroutine and its return value is used to resolve the promise
 // (or reject it if an error is returned).
@@ -989,7 +3967,7 @@ func makePromise(f func() (any, error)) js.Value {
 			if res, err := f(); err == nil {
 				resolve.Invoke(res)
 			} else {
-				reject.Invoke(err.Error())
+				reject.Invoke(toJSError(err))
 			}
 		}()
 		return nil
@@ -999,6 +3977,196 @@ func makePromise(f func() (any, error)) js.Value {
 	return promiseConstructor.New(handler)
 }
 
+// awaitPromise blocks until p settles. It must not be called from the
+// goroutine handling a JS call.
+func awaitPromise(p js.Value) (js.Value, error) {
+	type result struct {
+		val js.Value
+		err error
+	}
+	c := make(chan result, 1)
+	onFulfilled := js.FuncOf(func(this js.Value, args []js.Value) any {
+		c <- result{val: args[0]}
+		return nil
+	})
+	defer onFulfilled.Release()
+	onRejected := js.FuncOf(func(this js.Value, args []js.Value) any {
+		c <- result{err: errors.New(args[0].Call("toString").String())}
+		return nil
+	})
+	defer onRejected.Release()
+
+	p.Call("then", onFulfilled, onRejected)
+	res := <-c
+	return res.val, res.err
+}
+
+// newPromise returns a pending JS promise and the functions settling it, for
+// results that are produced outside of a single goroutine.
+func newPromise() (promise js.Value, resolve func(any), reject func(error)) {
+	var jsResolve, jsReject js.Value
+	handler := js.FuncOf(func(this js.Value, args []js.Value) any {
+		jsResolve = args[0]
+		jsReject = args[1]
+		return nil
+	})
+	defer handler.Release()
+
+	promise = js.Global().Get("Promise").New(handler)
+	resolve = func(res any) { jsResolve.Invoke(res) }
+	reject = func(err error) { jsReject.Invoke(toJSError(err)) }
+	return promise, resolve, reject
+}
+
+type logLevel int
+
+// Log levels, matching the logLevel of the app config.
+const (
+	logLevelOff logLevel = iota
+	logLevelError
+	logLevelWarn
+	logLevelInfo
+	logLevelDebug
+	logLevelTrace
+)
+
+var logLevelNames = []string{"OFF", "ERROR", "WARN", "INFO", "DEBUG", "TRACE"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// logs receives all logs of the bridge and of the Tailscale components,
+// including the log package.
+var logs = &jsLogger{level: logLevelInfo}
+
+// jsLogger filters logs by level and passes them to the logCallback of the
+// config, or prints them to the console without one.
+type jsLogger struct {
+	mu       sync.Mutex
+	level    logLevel
+	callback js.Value
+
+	// recent holds the last logRingSize lines of INFO and above, or of the
+	// configured level if more verbose, for debugBundle.
+	recent     [logRingSize]string
+	recentNext int
+}
+
+const logRingSize = 1000
+
+// configure applies the logLevel and logCallback options of config.
+func (l *jsLogger) configure(config js.Value) error {
+	level := logLevelInfo
+	if jsLevel := config.Get("logLevel"); jsLevel.Type() == js.TypeString {
+		i := slices.Index(logLevelNames, strings.ToUpper(jsLevel.String()))
+		if i < 0 {
+			return jsErrorf(errCodeInvalidArgument, "logLevel must be one of %s", strings.Join(logLevelNames, ", "))
+		}
+		level = logLevel(i)
+	}
+	callback := config.Get("logCallback")
+	if callback.Type() != js.TypeFunction {
+		callback = js.Undefined()
+	}
+
+	l.mu.Lock()
+	l.level, l.callback = level, callback
+	l.mu.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(l)
+	return nil
+}
+
+func (l *jsLogger) enabled(level logLevel) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return level <= l.level
+}
+
+func (l *jsLogger) printf(level logLevel, subsystem, format string, args ...any) {
+	show := l.enabled(level)
+	if !show && level > logLevelInfo {
+		return
+	}
+	now := time.Now()
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+
+	l.mu.Lock()
+	l.recent[l.recentNext%logRingSize] = fmt.Sprintf("%s %s %s: %s", now.UTC().Format(time.RFC3339Nano), level, subsystem, msg)
+	l.recentNext++
+	callback := l.callback
+	l.mu.Unlock()
+	if !show {
+		return
+	}
+	if callback.IsUndefined() {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", level, subsystem, msg)
+		return
+	}
+	callback.Invoke(level.String(), subsystem, msg)
+}
+
+// recentLines returns the buffered lines, oldest first.
+func (l *jsLogger) recentLines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := max(0, l.recentNext-logRingSize)
+	lines := make([]string, 0, l.recentNext-start)
+	for n := start; n < l.recentNext; n++ {
+		lines = append(lines, l.recent[n%logRingSize])
+	}
+	return lines
+}
+
+// logf returns a logger for a Tailscale component.
+func (l *jsLogger) logf(subsystem string) logger.Logf {
+	return func(format string, args ...any) {
+		level, format := logLevelOf(format)
+		l.printf(level, subsystem, format, args...)
+	}
+}
+
+// Write receives the output of the log package.
+func (l *jsLogger) Write(b []byte) (int, error) {
+	level, msg := logLevelOf(string(b))
+	l.printf(level, "log", "%s", msg)
+	return len(b), nil
+}
+
+// logLevelOf returns the level of a Tailscale log line and the line without
+// its verbosity prefix. Lines are INFO unless marked as verbose ([v1] is
+// DEBUG, [v2] TRACE) or unexpected (WARN).
+func logLevelOf(s string) (logLevel, string) {
+	if rest, ok := strings.CutPrefix(s, "[v1] "); ok {
+		return logLevelDebug, rest
+	}
+	if rest, ok := strings.CutPrefix(s, "[v2] "); ok {
+		return logLevelTrace, rest
+	}
+	if strings.HasPrefix(s, "[unexpected]") {
+		return logLevelWarn, s
+	}
+	return logLevelInfo, s
+}
+
+func (l *jsLogger) errorf(format string, args ...any) {
+	l.printf(logLevelError, "bridge", format, args...)
+}
+
+func (l *jsLogger) warnf(format string, args ...any) {
+	l.printf(logLevelWarn, "bridge", format, args...)
+}
+
+func (l *jsLogger) debugf(format string, args ...any) {
+	l.printf(logLevelDebug, "bridge", format, args...)
+}
+
+func (l *jsLogger) tracef(format string, args ...any) {
+	l.printf(logLevelTrace, "bridge", format, args...)
+}
+
 const logPolicyStateKey = "log-policy"
 
 func getOrCreateLogPolicyConfig(state ipn.StateStore) *logpolicy.Config {
@@ -1006,14 +4174,14 @@ func getOrCreateLogPolicyConfig(state ipn.StateStore) *logpolicy.Config {
 		if config, err := logpolicy.ConfigFromBytes(configBytes); err == nil {
 			return config
 		} else {
-			log.Printf("Could not parse log policy config: %v", err)
+			logs.errorf("Could not parse log policy config: %v", err)
 		}
 	} else if err != ipn.ErrStateNotExist {
-		log.Printf("Could not get log policy config from state store: %v", err)
+		logs.errorf("Could not get log policy config from state store: %v", err)
 	}
 	config := logpolicy.NewConfig("")
 	if err := state.WriteState(logPolicyStateKey, config.ToBytes()); err != nil {
-		log.Printf("Could not save log policy config to state store: %v", err)
+		logs.errorf("Could not save log policy config to state store: %v", err)
 	}
 	return config
 }
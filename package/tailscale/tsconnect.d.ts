@@ -9,15 +9,143 @@ export {};
  */
 
 declare global {
+  /**
+   * Functions of the IPN throw, and promises reject with, an IPNError. Caller
+   * mistakes never terminate the Go runtime.
+   */
   function newIPN(config: IPNConfig): IPN;
 
+  /**
+   * - EINVAL: invalid arguments
+   * - ETIMEDOUT: the operation or connection timed out
+   * - ENOTRUNNING: the backend is not connected to the tailnet
+   * - EACLDENIED: the tailnet policy does not allow the connection
+   * - ECONNRESET: the remote side reset the connection
+   * - EOF: the remote side closed the connection
+   * - ELOCALCLOSE: the session was closed by calling close()
+   * - EPIPE: the session was already closed
+   * - ENOBUFS: the write queue has no room left
+   * - EHOSTUNREACH: no route to the destination, e.g. no exit node selected
+   * - ENOTSUP: the operation is not supported
+   * - EIO: any other error
+   */
+  type IPNErrorCode =
+    | "EINVAL"
+    | "ETIMEDOUT"
+    | "ENOTRUNNING"
+    | "EACLDENIED"
+    | "ECONNRESET"
+    | "EOF"
+    | "ELOCALCLOSE"
+    | "EPIPE"
+    | "ENOBUFS"
+    | "EHOSTUNREACH"
+    | "ENOTSUP"
+    | "EIO";
+
+  interface IPNError extends Error {
+    code: IPNErrorCode;
+  }
+
   interface IPN {
     run(callbacks: IPNCallbacks): void;
-    login(): void;
-    logout(): void;
-    newProfile(): void;
-    deleteProfile(id: string): void;
-    switchProfile(id: string): void;
+    /**
+     * Resolves once the backend is Running or with the browseToURL the user
+     * has to visit to log in.
+     */
+    login(): Promise<IPNStateResult>;
+    /** The profile operations resolve once the backend restarted */
+    logout(): Promise<IPNStateResult>;
+    newProfile(): Promise<IPNStateResult>;
+    deleteProfile(id: string): Promise<IPNStateResult>;
+    switchProfile(id: string): Promise<IPNStateResult>;
+    listProfiles(): IPNProfile[];
+    /** null if the current profile was not persisted yet */
+    currentProfile(): IPNProfile | null;
+    /**
+     * JSON document with the state, prefs, netmap summary, DERP map, health,
+     * recent logs and open sessions, to attach to bug reports. Keys, auth
+     * keys and login URLs are redacted unless includeSecrets is set.
+     */
+    debugBundle(options?: { includeSecrets?: boolean }): string;
+    /**
+     * Current netmap, null before the first one arrived.
+     * @returns JSON encoded IPNNetMap
+     */
+    getNetMap(): string | null;
+    /**
+     * Only checks whether the peer is reachable at all, not ports or
+     * protocols. Peers that are not visible, filtered by Tailnet Lock or
+     * expired are denied, everything else is unknown because peers enforce
+     * their own policy. Denied peers make tcp(), ssh() and fetch() fail with
+     * EACLDENIED instead of timing out.
+     * @param peer IP, node ID, stable node ID, MagicDNS name or hostname
+     */
+    canConnect(peer: string): IPNACLResult;
+    /**
+     * Dials the ports of peer concurrently and detects the protocols behind
+     * them. Open ports are cached until the netmap changes, closed ones are
+     * dialed again on every call.
+     * @param ports Defaults to 22, 3389, 5900, 5901, 80, 443 and 8080
+     * @param timeoutMs Per port, must be positive, defaults to 3000
+     */
+    probeServices(
+      peer: string,
+      ports?: number[],
+      timeoutMs?: number,
+    ): Promise<IPNProbeResult[]>;
+    /** Like `tailscale ping` */
+    ping(
+      peer: string,
+      options?: {
+        /** Defaults to disco */
+        type?: "disco" | "TSMP" | "ICMP" | "peerapi";
+        /** Defaults to 10 */
+        count?: number;
+        /** Per attempt, defaults to 5000 */
+        timeoutMs?: number;
+        /** Stop at the first direct pong. Defaults to true */
+        untilDirect?: boolean;
+        onAttempt?: (attempt: IPNPingAttempt) => void;
+      },
+    ): Promise<{
+      address: string;
+      type: string;
+      direct: boolean;
+      attempts: IPNPingAttempt[];
+    }>;
+    /**
+     * Measures the HTTPS latency to each DERP region. The last report is
+     * included in debugBundle().
+     */
+    derpReport(): Promise<IPNDERPReport>;
+    /** Current unhealthy warnables, most severe first */
+    health(): IPNHealthWarning[];
+    getPrefs(): IPNPrefs;
+    suggestExitNode(): Promise<{
+      /** Stable node ID */
+      id: string;
+      name: string;
+      location?: {
+        country: string;
+        countryCode: string;
+        city: string;
+        cityCode: string;
+      };
+    }>;
+    tkaStatus(): IPNTKAStatus;
+    /**
+     * Signs another node with the Tailnet Lock key of this node, rejects with
+     * ENOTSUP unless the key is trusted.
+     * @param nodeKey nodekey:...
+     * @param rotationKey tlpub:...
+     */
+    tkaSign(nodeKey: string, rotationKey?: string): Promise<void>;
+    /**
+     * Changes only the prefs present in patch, resolves with the new prefs.
+     * Rejects with EINVAL for unknown keys and invalid values.
+     */
+    editPrefs(patch: IPNPrefsPatch): Promise<IPNPrefs>;
     ssh(
       host: string,
       username: string,
@@ -32,6 +160,9 @@ declare global {
         onConnectionProgress: (message: string) => void;
         onConnected: () => void;
         onDone: () => void;
+        onStats?: (stats: IPNSessionStats) => void;
+        /** Defaults to 1000 */
+        statsIntervalMs?: number;
       }
     ): IPNSSHSession;
     fetch(options: IPNFetchOptions): Promise<IPNFetchResponse>;
@@ -40,25 +171,262 @@ declare global {
       port: number;
       readCallback: (data: Uint8Array) => void;
       connectTimeoutSeconds?: number;
+      /** High-water mark of the write queue. Defaults to 1 MiB */
       writeBufferSizeInBytes?: number;
+      /** Writes exceeding this are rejected. Defaults to 16 MiB */
+      maxWriteQueueSizeInBytes?: number;
+      /**
+       * Called with true once the write queue exceeds writeBufferSizeInBytes
+       * and with false once it drained to a quarter of it.
+       */
+      onBackpressure?: (active: boolean) => void;
       readBufferSizeInBytes?: number;
+      /**
+       * shared (default): chunks are subarrays of one buffer, only valid
+       * until readCallback returns. owned: every chunk is a new buffer.
+       * pooled: chunks are owned by the caller until passed to release(),
+       * then their buffer is reused.
+       */
+      readMode?: "shared" | "owned" | "pooled";
+      /** Coalesce small reads up to this many bytes. Disabled by default */
+      readCoalesceBytes?: number;
+      /** Max delay of coalesced reads. Defaults to 5ms */
+      readCoalesceDelayMs?: number;
+      /** Called once the connection is closed, for any reason */
+      onClose?: (reason: IPNTCPCloseReason) => void;
+      /** Called before onClose if the connection failed */
+      onError?: (err: IPNTCPCloseReason) => void;
+      /** Called periodically, e.g. to draw a throughput graph */
+      onStats?: (stats: IPNSessionStats) => void;
+      /** Defaults to 1000 */
+      statsIntervalMs?: number;
     }): Promise<IPNTCPSession>;
-    /** Experimental */
-    resolve(hostname: string): Promise<{
-      result: string;
-      resolvers: string[];
-    }>;
+    /**
+     * Sends a file with Taildrop to a peer with taildropTarget set. Resolves
+     * with the number of bytes sent.
+     * @param peerID netmap or stable node ID
+     */
+    sendFile(
+      peerID: string,
+      name: string,
+      data: Uint8Array | ReadableStream<Uint8Array>,
+      options?: {
+        /** Size of a ReadableStream, -1 if unknown */
+        size?: number;
+        /** Throttled to about 10 calls per second, total is -1 if unknown */
+        onProgress?: (sent: number, total: number) => void;
+      },
+    ): Promise<number>;
+    /** Received files, kept in memory until deleted or the page is closed */
+    waitingFiles(): Promise<IPNWaitingFile[]>;
+    openFile(name: string): Promise<
+      IPNWaitingFile & {
+        stream: ReadableStream<Uint8Array>;
+      }
+    >;
+    deleteFile(name: string): Promise<void>;
+    /**
+     * Resolves through MagicDNS and the split DNS routes of the tailnet.
+     * Names without dots are tried with the MagicDNS suffix and the search
+     * domains first.
+     * @param name A name, or an IP for PTR
+     * @param type Defaults to A
+     */
+    resolve(name: string, type?: IPNDNSRecordType): Promise<IPNDNSResult>;
+    /**
+     * Resolves the presets of /connections.json against the current netmap.
+     * @returns JSON encoded IPNResolvedConnection[]
+     */
+    resolveConnections(connectionsJSON: string): string;
   }
 
+  type IPNProfile = {
+    id: string;
+    name: string;
+    controlURL: string;
+    userLogin: string;
+    tailnet: string;
+    /** Only known for the current profile */
+    nodeName: string;
+    current: boolean;
+  };
+
+  type IPNPrefs = {
+    controlURL: string;
+    wantRunning: boolean;
+    /** Stable node ID */
+    exitNodeID: string;
+    exitNodeIP: string;
+    exitNodeAllowLANAccess: boolean;
+    /** Accept routes */
+    routeAll: boolean;
+    shieldsUp: boolean;
+    hostname: string;
+    advertiseTags: string[];
+    corpDNS: boolean;
+  };
+
+  type IPNPrefsPatch = Partial<
+    Pick<
+      IPNPrefs,
+      | "exitNodeAllowLANAccess"
+      | "routeAll"
+      | "shieldsUp"
+      | "hostname"
+      | "advertiseTags"
+      | "corpDNS"
+    >
+  > & {
+    /**
+     * IP, stable node ID or netmap node ID. "auto" selects the suggested exit
+     * node, "" or null clears it. fetch() and tcp() to destinations outside
+     * of the tailnet go through the exit node.
+     */
+    exitNode?: string | null;
+  };
+
+  type IPNWaitingFile = {
+    name: string;
+    size: number;
+  };
+
+  type IPNIncomingFiles = {
+    /** Files currently being received */
+    incoming: {
+      name: string;
+      /** Unix milliseconds */
+      started: number;
+      /** -1 if unknown */
+      declaredSize: number;
+      received: number;
+    }[];
+    waiting: IPNWaitingFile[];
+  };
+
+  type IPNTKAStatus = {
+    enabled: boolean;
+    /** Hex encoded hash of the latest AUM, set if enabled */
+    head?: string;
+    /** Tailnet Lock key of this node, tlpub:... */
+    publicKey: string;
+    nodeKey: string;
+    nodeKeySigned: boolean;
+    /** The Tailnet Lock key of this node is trusted, see tkaSign() */
+    canSign: boolean;
+    /**
+     * Command an administrator has to run on a signing node while this node
+     * is locked out, empty otherwise.
+     */
+    signCommand: string;
+    trustedKeys: {
+      key: string;
+      metadata: Record<string, string> | null;
+      votes: number;
+    }[];
+    /** Peers removed from the netmap because of a missing signature */
+    filteredPeers: {
+      id: string;
+      name: string;
+      addresses: string[];
+      nodeKey: string;
+    }[];
+  };
+
+  type IPNHealthWarning = {
+    /** e.g. "no-derp-connection" or "login-state" */
+    code: string;
+    severity: "high" | "medium" | "low";
+    title: string;
+    text: string;
+    /** Unix milliseconds */
+    brokenSince: number | null;
+    impactsConnectivity: boolean;
+    /** Hide the warning while any of these codes is unhealthy */
+    dependsOn: string[];
+  };
+
+  type IPNStateResult = {
+    state: IPNState;
+    profile: IPNProfile | null;
+    browseToURL?: string;
+  };
+
+  type IPNConnectionPreset = {
+    name: string;
+    protocol: "ssh" | "vnc" | "rdp" | "http";
+    peer?: string;
+    tag?: string;
+    port?: number;
+    username?: string;
+    scheme?: "http" | "https";
+    path?: string;
+  };
+
+  type IPNResolvedConnection = IPNConnectionPreset & {
+    port: number;
+    targets: {
+      id: string;
+      name: string;
+      address: string;
+      online: boolean;
+    }[];
+    reachable: boolean;
+  };
+
+  type IPNSessionStats = {
+    bytesSent: number;
+    bytesReceived: number;
+    messagesSent: number;
+    messagesReceived: number;
+    ageMs: number;
+    /** Unix milliseconds */
+    lastActivity: number;
+    idleMs: number;
+    /** Bytes waiting to be written, not set for SSH sessions */
+    writeQueueBytes?: number;
+    path: {
+      type: "direct" | "derp" | "unknown";
+      peer?: string;
+      /** Set if type is direct */
+      endpoint?: string;
+      /** Set if type is derp */
+      derpRegion?: string;
+    };
+    /** Unix milliseconds the stats were taken at */
+    time: number;
+  };
+
   interface IPNSSHSession {
     resize(rows: number, cols: number): boolean;
     close(): boolean;
+    stats(): IPNSessionStats;
   }
 
+  type IPNTCPCloseReason = {
+    code: Extract<
+      IPNErrorCode,
+      "EOF" | "ECONNRESET" | "ETIMEDOUT" | "ELOCALCLOSE" | "EIO"
+    >;
+    message: string;
+  };
+
   interface IPNTCPSession {
     remoteAddr: string;
+    /** Resolves once the connection is closed, never rejects */
+    closed: Promise<IPNTCPCloseReason>;
     close(): Promise<void>;
+    /** Half-close after all queued writes, reads continue until EOF */
+    closeWrite(): Promise<void>;
+    /** Writes are queued, the promises resolve in order */
     write(buffer: Uint8Array): Promise<number>;
+    /** Bytes queued but not yet written */
+    bufferedAmount(): number;
+    /** Stop delivering data to readCallback */
+    pause(): void;
+    resume(): void;
+    /** Hands a chunk back in pooled readMode, it must not be used afterwards */
+    release(chunk: Uint8Array): void;
+    stats(): IPNSessionStats;
   }
 
   interface IPNStateStorage {
@@ -73,13 +441,42 @@ declare global {
     hostname?: string;
     routeAll?: boolean;
     advertiseTags?: string;
+    /** Pins the home DERP region, peers are reached through it */
+    preferredDERPRegion?: number;
+    /** Minimum interval between netmap notifications. Defaults to 250 */
+    netMapThrottleMs?: number;
+    /** Defaults to INFO. TRACE includes every notification of the backend */
+    logLevel?: IPNLogLevel;
+    /** Receives the logs instead of the console */
+    logCallback?: (
+      level: Exclude<IPNLogLevel, "OFF">,
+      /** e.g. bridge, ipnlocal, wgengine or netstack */
+      subsystem: string,
+      message: string,
+    ) => void;
   };
 
+  type IPNLogLevel = "OFF" | "ERROR" | "WARN" | "INFO" | "DEBUG" | "TRACE";
+
   type IPNCallbacks = {
     notifyState: (state: IPNState) => void;
+    /**
+     * Called when the netmap changes, and when the current address of a peer
+     * changes on an engine status update
+     */
     notifyNetMap: (netMapStr: string) => void;
+    /**
+     * If set, notifyNetMap is only called for the first netmap and when
+     * something besides the peers changed. Peer changes are passed here.
+     */
+    notifyPeersChanged?: (delta: IPNPeersDelta) => void;
     notifyBrowseToURL: (url: string) => void;
     notifyPanicRecover: (err: string) => void;
+    notifyPrefs?: (prefs: IPNPrefs) => void;
+    /** Called while files are received and when the waiting files change */
+    notifyIncomingFiles?: (files: IPNIncomingFiles) => void;
+    /** Called with all current warnings whenever one appears or clears */
+    notifyHealth?: (warnings: IPNHealthWarning[]) => void;
   };
 
   type IPNNetMap = {
@@ -97,6 +494,13 @@ declare global {
     nodeKey: string;
     createdAt: string;
     ipnVersion: string;
+    stableID: string;
+    /** OS hostname, name is the MagicDNS name */
+    hostname: string;
+    /** RFC 3339, empty if the key does not expire */
+    keyExpiry: string;
+    /** DERP region ID, 0 if unknown */
+    homeDERP: number;
   };
 
   type IPNNetMapUsers = {
@@ -111,6 +515,20 @@ declare global {
 
   type IPNNetMapSelfNode = IPNNetMapNode & {
     machineStatus: IPNMachineStatus;
+    tags: string[] | null;
+    user: {
+      loginName: string;
+      displayName: string;
+      profilePicURL: string;
+    };
+    dns: {
+      magicDNS: boolean;
+      resolvers: string[];
+      /** Search domains */
+      domains: string[];
+      /** Resolvers by domain suffix */
+      routes: Record<string, string[]>;
+    };
   };
 
   type IPNNetMapPeerNode = IPNNetMapNode & {
@@ -124,6 +542,114 @@ declare global {
     online: boolean;
     expired: boolean;
     tailscaleSSHEnabled: boolean;
+    /** Advertises 0.0.0.0/0 and ::/0 */
+    exitNode: boolean;
+    /** Files can be sent to the peer with sendFile() */
+    taildropTarget: boolean;
+    /** Primary router of a subnet */
+    subnetRouter: boolean;
+    /** Routes this peer is the primary router of */
+    primaryRoutes: string[] | null;
+    endpoints: string[];
+    /** Endpoint of the direct path, empty if relayed through DERP */
+    curAddr: string;
+    direct: boolean;
+    /** Services advertised by the peer, e.g. open ports */
+    services: {
+      proto: string;
+      port: number;
+      description: string;
+    }[];
+  };
+
+  type IPNACLVerdict = "allowed" | "denied" | "unknown";
+
+  type IPNACLResult = {
+    result: IPNACLVerdict;
+    reason: string;
+    /** Address the peer resolved to, empty if unknown */
+    address: string;
+  };
+
+  type IPNProbeResult = {
+    port: number;
+    open: boolean;
+    /** Set if open */
+    protocol?: "ssh" | "vnc" | "rdp" | "http" | "https" | "unknown";
+    /** SSH or RFB version, or the HTTP Server header */
+    banner?: string;
+    /** Set if not open */
+    error?: IPNErrorCode;
+  };
+
+  type IPNPingAttempt = {
+    seq: number;
+    /** Set if the attempt failed */
+    error?: IPNErrorCode;
+    message?: string;
+    latencyMs?: number;
+    nodeName?: string;
+    /** Tailscale IP of the node that answered, e.g. a subnet router */
+    nodeIP?: string;
+    /** unknown for TSMP and ICMP pings */
+    path?: "direct" | "derp" | "unknown";
+    /** Set if direct */
+    endpoint?: string;
+    /** Set if relayed through DERP */
+    derpRegion?: { id: number; code: string };
+    peerAPIPort?: number;
+  };
+
+  type IPNDERPReport = {
+    /** Unix milliseconds */
+    time: number;
+    /** Region IDs, 0 if unknown or not pinned */
+    homeRegion: number;
+    /** Region the measurement prefers */
+    preferredRegion: number;
+    pinnedRegion: number;
+    /** Fastest first, unreachable regions last */
+    regions: {
+      id: number;
+      code: string;
+      name: string;
+      /** null if unreachable */
+      latencyMs: number | null;
+    }[];
+  };
+
+  type IPNDNSRecordType = "A" | "AAAA" | "CNAME" | "SRV" | "TXT" | "PTR";
+
+  type IPNDNSResult = {
+    /** The name that was queried */
+    name: string;
+    type: IPNDNSRecordType;
+    /** e.g. NOERROR, NXDOMAIN or SERVFAIL */
+    rcode: string;
+    /** netmap for reverse lookups of tailnet IPs */
+    source: "dns" | "netmap";
+    answers: {
+      name: string;
+      /** May differ from the queried type, e.g. CNAME */
+      type: string;
+      ttl: number;
+      /** null for record types that are not parsed */
+      data:
+        | string
+        | string[]
+        | { priority: number; weight: number; port: number; target: string }
+        | null;
+    }[];
+    /** Upstream resolvers used for the name, empty for MagicDNS names */
+    resolvers: string[];
+  };
+
+  type IPNPeersDelta = {
+    added: IPNNetMapPeerNode[];
+    /** IDs of the removed peers */
+    removed: string[];
+    /** Only the fields that changed, fields that were dropped are null */
+    changed: (Partial<IPNNetMapPeerNode> & { id: string })[];
   };
 
   /** Mirrors values from ipn/backend.go */
@@ -10,6 +10,8 @@ export interface AppConfig {
   controlUrl: string;
   /** Only apply when using a authkey */
   tags: string[];
+  /** DERP region used as home region instead of the closest one */
+  preferredDERPRegion?: number;
   /** User settings defaults. See `./settings` */
   defaults: UserSettings;
 }
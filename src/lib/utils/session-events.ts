@@ -0,0 +1,55 @@
+import { get } from "svelte/store";
+
+import { netMap } from "$lib/store/ipn";
+
+export type SessionEventType = "session.start" | "session.end";
+export type SessionProtocol = "ssh" | "vnc" | "rdp";
+
+export interface Session {
+  protocol: SessionProtocol;
+  hostname: string;
+  address?: string;
+  username?: string;
+}
+
+/**
+ * Reports an interactive session to the server, which notifies the configured
+ * webhooks. The server adds the authenticated user. Servers without webhooks
+ * answer with 404, failures never interrupt the session.
+ */
+export async function reportSessionEvent(
+  type: SessionEventType,
+  session: Session,
+): Promise<void> {
+  const peer = findPeer(session.hostname);
+  try {
+    const res = await fetch("./events", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        type,
+        protocol: session.protocol,
+        peer: peer?.name || session.hostname,
+        peerTags: peer?.tags || undefined,
+        address: session.address || peer?.addresses[0] || undefined,
+        username: session.username || undefined,
+      }),
+    });
+    if (!res.ok && res.status !== 404) {
+      console.warn(`Failed to report ${type}: ${res.status} ${res.statusText}`);
+    }
+  } catch (err) {
+    console.warn(`Failed to report ${type}:`, err);
+  }
+}
+
+function findPeer(hostname: string): IPNNetMapPeerNode | undefined {
+  const name = hostname.replace(/\.$/, "").toLowerCase();
+  return get(netMap)?.peers.find(
+    (peer) =>
+      peer.addresses.includes(name) ||
+      peer.name.replace(/\.$/, "").toLowerCase() === name ||
+      peer.name.split(".")[0].toLowerCase() === name ||
+      peer.hostname.toLowerCase() === name,
+  );
+}
@@ -92,6 +92,8 @@ declare global {
       authKey: urlParameters.authKey,
       controlURL: cfg.controlUrl,
       advertiseTags: [...urlParameters.tags, ...cfg.tags].join(";"),
+      logLevel: cfg.logLevel,
+      preferredDERPRegion: cfg.preferredDERPRegion,
     }),
     appRouter: new AppRouter({
       target: appEl,
@@ -119,7 +121,12 @@ declare global {
           window.appRouter.resolve();
 
           if (!Object.keys(window.ipnProfiles.profiles).length) {
-            window.ipn.login();
+            try {
+              await window.ipn.login();
+            } catch (err) {
+              console.error(err);
+              toast.error("Failed to log in: " + err?.toString());
+            }
           }
 
           break;
@@ -176,6 +183,28 @@ declare global {
     },
   );
 
+  window.ipnEventHandler.addEventListener(
+    window.ipnEventHandler.Events.peersChanged,
+    ({ detail: { delta } }) => {
+      netMap.update((nm) => {
+        if (!nm) return nm;
+        const removed = new Set(delta.removed);
+        const changed = new Map(delta.changed.map((p) => [p.id, p]));
+        return {
+          ...nm,
+          peers: [
+            ...nm.peers
+              .filter((p) => !removed.has(p.id))
+              .map((p) =>
+                changed.has(p.id) ? { ...p, ...changed.get(p.id) } : p,
+              ),
+            ...delta.added,
+          ],
+        };
+      });
+    },
+  );
+
   window.ipnEventHandler.addEventListener(
     window.ipnEventHandler.Events.panicRecover,
     (ev) => {